@@ -0,0 +1,69 @@
+package main
+
+import (
+	"FullText_SearchEngine/handlers"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runAnalyze implements the "analyze" subcommand: it prints the token stream of a text after every stage of
+// the analyzer selected by the flags, so tokenization can be checked without building an index.
+// The text is taken from the arguments, or read line by line from the standard input when there is none.
+// Flags may follow the subcommand, e.g. "./yourApp analyze -lang french les étés".
+// Parameters:
+//
+//	args: the command-line arguments following the subcommand.
+func runAnalyze(args []string) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return
+	}
+	options, err := engineConfig.options()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	engine := handlers.New(options...)
+	if flag.NArg() > 0 {
+		printStages(os.Stdout, engine.TraceAnalysis(strings.Join(flag.Args(), " ")))
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		printStages(os.Stdout, engine.TraceAnalysis(scanner.Text()))
+		fmt.Println()
+	}
+}
+
+// printStages writes every analysis stage on its own line.
+func printStages(writer io.Writer, stages []handlers.AnalysisStage) {
+	for _, stage := range stages {
+		fmt.Fprintln(writer, stage)
+	}
+}
+
+// AnalyzeHandler handles the "/analyze" path and shows how the SearchEngine analyzes a text.
+// It takes the text from the "text" parameter, or the abstract of the document whose ID is in the "id" parameter,
+// and writes the token stream after every stage of the analyzer as plain text.
+func AnalyzeHandler(writer http.ResponseWriter, request *http.Request) {
+	text := request.FormValue("text")
+	if id := request.FormValue("id"); id != "" {
+		docID, err := strconv.Atoi(id)
+		if err != nil || docID < 0 || docID >= len(SearchEngine.Documents) {
+			http.Error(writer, "Invalid document ID", http.StatusBadRequest)
+			return
+		}
+		text = SearchEngine.Documents[docID].Text
+	}
+	if len(text) == 0 {
+		http.Error(writer, "No text provided", http.StatusBadRequest)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	printStages(writer, SearchEngine.TraceAnalysis(text))
+}
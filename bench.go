@@ -0,0 +1,371 @@
+package main
+
+import (
+	"FullText_SearchEngine/handlers"
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchOptions holds the flags of the "bench" subcommand.
+type benchOptions struct {
+	queries     string // Path to the JSONL query log.
+	url         string // Server to replay the queries against, or "" for an in-process index.
+	compare     string // Second index build: a server URL or a document file.
+	concurrency int    // Number of queries run at the same time.
+	repeat      int    // Number of times the log is replayed.
+	topK        int    // Number of top hits compared between the builds.
+}
+
+// benchExamples is the number of differing queries printed when two index builds are compared.
+const benchExamples = 10
+
+// runBench implements the "bench" subcommand: it replays the queries of a query log against an in-process
+// SearchEngine built from -file, or against the server at -url, and reports latency percentiles and throughput.
+// With -compare, the queries are also replayed against a second index build, and the queries whose results
+// differ between the two builds are reported. With -variant, the second build is indexed in-process with the
+// variant flags applied on top of the others, from the -compare file or, without one, from -file.
+// Parameters:
+//
+//	args: the command-line arguments following the subcommand.
+func runBench(args []string) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return
+	}
+	if err := bench(os.Stdout, benchConfig, evalConfig.variant); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// bench replays the query log as configured and writes the report. variant holds the flags of the second
+// in-process index build, or is "".
+func bench(w io.Writer, config benchOptions, variant string) error {
+	if config.queries == "" {
+		return fmt.Errorf("usage: ./yourApp bench [-file <path_to_xml_file> | -url <server>] [-compare <server_or_file>] [-variant <flags>] -queries <query_log.jsonl>")
+	}
+	if config.concurrency < 1 || config.repeat < 1 || config.topK < 1 {
+		return fmt.Errorf("-concurrency, -repeat and -k must be at least 1")
+	}
+	queries, err := readQueryLog(config.queries)
+	if err != nil {
+		return err
+	}
+	if len(queries) == 0 {
+		return fmt.Errorf("%s: no queries", config.queries)
+	}
+
+	// Build or connect to the index builds.
+	target, err := newBenchTarget(config.url, searchFilePath, config.topK, engineConfig)
+	if err != nil {
+		return err
+	}
+	var targets = []benchTarget{target}
+	if config.compare != "" || variant != "" {
+		location := config.compare
+		if location == "" {
+			location = searchFilePath
+		}
+		settings := engineConfig
+		if variant != "" {
+			if isServerURL(location) {
+				return fmt.Errorf("-variant configures an in-process index build, not the server at %s", location)
+			}
+			if settings, err = engineConfig.withVariant(variant); err != nil {
+				return err
+			}
+		}
+		compared, err := newBenchTarget(location, location, config.topK, settings)
+		if err != nil {
+			return err
+		}
+		if engine, ok := compared.(*engineTarget); ok {
+			engine.variant = variant
+		}
+		targets = append(targets, compared)
+	}
+
+	// Replay the log against every build, one after the other so they do not compete for the CPU.
+	var reports []*benchReport
+	for _, target := range targets {
+		report := replay(target, queries, config.concurrency, config.repeat)
+		report.print(w)
+		reports = append(reports, report)
+	}
+	if len(reports) == 2 {
+		compareReports(w, queries, reports[0], reports[1], config.topK)
+	}
+	return nil
+}
+
+// readQueryLog reads the queries of a JSONL query log written with -query-log, in order.
+func readQueryLog(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var queries []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry QueryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if entry.Query != "" {
+			queries = append(queries, entry.Query)
+		}
+	}
+	return queries, scanner.Err()
+}
+
+// benchOutcome is the result of a replayed query: the number of matching documents and the IDs of the top hits.
+type benchOutcome struct {
+	total int
+	top   []int
+	err   error
+}
+
+// benchTarget is an index build the queries are replayed against.
+type benchTarget interface {
+	search(ctx context.Context, query string) benchOutcome
+	String() string
+}
+
+// isServerURL reports whether the location of an index build is the URL of a server rather than a document file.
+func isServerURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// newBenchTarget returns the server at location when it is an HTTP URL, and otherwise indexes the document
+// file at path in-process, with the analyzer and index settings. The result cache of the in-process engine
+// is disabled, so repeated queries are measured rather than answered from the cache.
+func newBenchTarget(location string, path string, k int, settings engineSettings) (benchTarget, error) {
+	if isServerURL(location) {
+		return &serverTarget{url: strings.TrimSuffix(location, "/"), client: &http.Client{}, k: k}, nil
+	}
+	if path == "" {
+		return nil, fmt.Errorf("bench needs -file or -url")
+	}
+	engine, err := loadEngine(path, settings)
+	if err != nil {
+		return nil, err
+	}
+	engine.Cache = nil // Replayed latencies must measure the queries, not cache hits.
+	return &engineTarget{path: path, engine: engine, k: k}, nil
+}
+
+// engineTarget replays queries against an in-process SearchEngine, routed like the "/search" path does.
+type engineTarget struct {
+	path    string
+	variant string // Flags the engine was built with on top of the others, or "".
+	engine  *handlers.SearchEngine
+	k       int
+}
+
+// search runs the query, within the -timeout duration when one is set.
+func (t *engineTarget) search(ctx context.Context, query string) benchOutcome {
+	if queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+	}
+	result, err := runQuery(ctx, t.engine, queryModeOf(query), query)
+	if err != nil {
+		return benchOutcome{err: err}
+	}
+	ids := result.IDs()
+	return benchOutcome{total: result.Total, top: ids[:min(t.k, len(ids))]}
+}
+
+// String returns the name of the target in reports.
+func (t *engineTarget) String() string {
+	if t.variant != "" {
+		return fmt.Sprintf("in-process %s (%s)", t.path, t.variant)
+	}
+	return "in-process " + t.path
+}
+
+// serverTarget replays queries against the "/search" path of a running server, in its JSON format.
+type serverTarget struct {
+	url    string
+	client *http.Client
+	k      int
+}
+
+// search sends the query to the server.
+func (t *serverTarget) search(ctx context.Context, query string) benchOutcome {
+	address := fmt.Sprintf("%s/search?format=json&limit=%d&q=%s", t.url, t.k, url.QueryEscape(query))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return benchOutcome{err: err}
+	}
+	response, err := t.client.Do(request)
+	if err != nil {
+		return benchOutcome{err: err}
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return benchOutcome{err: fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(body)))}
+	}
+	var result jsonResult
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return benchOutcome{err: err}
+	}
+	outcome := benchOutcome{total: result.Total}
+	for _, hit := range result.Hits {
+		outcome.top = append(outcome.top, hit.ID)
+	}
+	return outcome
+}
+
+// String returns the name of the target in reports.
+func (t *serverTarget) String() string {
+	return t.url
+}
+
+// benchReport holds the measurements of a replay.
+type benchReport struct {
+	target    string
+	latencies []time.Duration // Latencies of the successful queries, sorted.
+	errors    int             // Number of failed queries.
+	wall      time.Duration   // Time spent replaying the log.
+	outcomes  []benchOutcome  // Outcome of every query of the log, from its first replay.
+}
+
+// replay runs every query of the log repeat times against the target with the given number of workers.
+func replay(target benchTarget, queries []string, concurrency int, repeat int) *benchReport {
+	n := len(queries) * repeat
+	latencies := make([]time.Duration, n)
+	outcomes := make([]benchOutcome, n)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				queryStart := time.Now()
+				outcomes[i] = target.search(context.Background(), queries[i%len(queries)])
+				latencies[i] = time.Since(queryStart)
+			}
+		}()
+	}
+	for i := range n {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := &benchReport{target: target.String(), wall: time.Since(start), outcomes: outcomes[:len(queries)]}
+	for i, outcome := range outcomes {
+		if outcome.err != nil {
+			report.errors++
+			continue
+		}
+		report.latencies = append(report.latencies, latencies[i])
+	}
+	slices.Sort(report.latencies)
+	return report
+}
+
+// percentile returns the latency below which the fraction p of the queries fall, using the nearest rank.
+func (r *benchReport) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(r.latencies)))) - 1
+	return r.latencies[max(rank, 0)].Round(time.Microsecond)
+}
+
+// print writes the throughput and latency percentiles of the replay, and the first error, if any.
+func (r *benchReport) print(w io.Writer) {
+	total := len(r.latencies) + r.errors
+	fmt.Fprintf(w, "%s: %d queries in %s, %d errors, %.1f queries/s\n",
+		r.target, total, r.wall.Round(time.Millisecond), r.errors, float64(total)/r.wall.Seconds())
+	fmt.Fprintf(w, "  latency p50 %s, p95 %s, p99 %s, max %s\n",
+		r.percentile(0.50), r.percentile(0.95), r.percentile(0.99), r.percentile(1))
+	for _, outcome := range r.outcomes {
+		if outcome.err != nil {
+			fmt.Fprintf(w, "  first error: %v\n", outcome.err)
+			break
+		}
+	}
+}
+
+// benchDifference is a query whose results differ between two index builds.
+type benchDifference struct {
+	query   string
+	a, b    benchOutcome
+	overlap float64 // Fraction of the top hits found by both builds.
+}
+
+// compareReports writes how the results of two replays of the same log differ: the queries whose number of
+// matching documents or top k hits changed, the mean overlap of the top k hits, and the queries that changed most.
+func compareReports(w io.Writer, queries []string, a *benchReport, b *benchReport, k int) {
+	var totals, tops, compared int
+	var overlaps float64
+	var differences []benchDifference
+	for i, query := range queries {
+		outcomeA, outcomeB := a.outcomes[i], b.outcomes[i]
+		if outcomeA.err != nil || outcomeB.err != nil {
+			continue
+		}
+		compared++
+		overlap := topOverlap(outcomeA.top, outcomeB.top)
+		overlaps += overlap
+		if outcomeA.total != outcomeB.total {
+			totals++
+		}
+		if !slices.Equal(outcomeA.top, outcomeB.top) {
+			tops++
+		}
+		if outcomeA.total != outcomeB.total || !slices.Equal(outcomeA.top, outcomeB.top) {
+			differences = append(differences, benchDifference{query: query, a: outcomeA, b: outcomeB, overlap: overlap})
+		}
+	}
+	fmt.Fprintf(w, "differences between %s and %s (%d queries compared):\n", a.target, b.target, compared)
+	if compared == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  number of results differs for %d queries\n", totals)
+	fmt.Fprintf(w, "  top %d differs for %d queries, mean overlap %.3f\n", k, tops, overlaps/float64(compared))
+	sort.SliceStable(differences, func(i, j int) bool {
+		return differences[i].overlap < differences[j].overlap
+	})
+	for _, d := range differences[:min(benchExamples, len(differences))] {
+		fmt.Fprintf(w, "  %q: %d -> %d results, top %d overlap %.2f\n", d.query, d.a.total, d.b.total, k, d.overlap)
+	}
+}
+
+// topOverlap returns the fraction of the top hits of the longer list found in the other one, or 1 when both are empty.
+func topOverlap(a []int, b []int) float64 {
+	size := max(len(a), len(b))
+	if size == 0 {
+		return 1
+	}
+	common := 0
+	for _, id := range a {
+		if slices.Contains(b, id) {
+			common++
+		}
+	}
+	return float64(common) / float64(size)
+}
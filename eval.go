@@ -0,0 +1,316 @@
+package main
+
+import (
+	"FullText_SearchEngine/handlers"
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// evalOptions holds the flags of the "eval" subcommand.
+type evalOptions struct {
+	qrels   string // Path to the TREC qrels file.
+	topics  string // Path to the queries, one "topic query" per line.
+	scorers string // Comma-separated scoring formulas to compare.
+	variant string // Flags of a second index configuration, or "".
+}
+
+// evalTopic is a query of the evaluated query set.
+type evalTopic struct {
+	id    string
+	query string
+}
+
+// evalMetrics holds the relevance metrics of a run, averaged over the evaluated topics.
+type evalMetrics struct {
+	topics    int     // Topics with at least one relevant document, which are evaluated.
+	precision float64 // Precision at k.
+	recall    float64 // Share of the relevant documents found at any rank.
+	ap        float64 // Mean average precision.
+	rr        float64 // Mean reciprocal rank of the first relevant document.
+	ndcg      float64 // Normalized discounted cumulative gain at k, with graded relevance.
+}
+
+// evalRun is an evaluated combination of an index configuration and a scoring formula.
+type evalRun struct {
+	configuration string
+	scoring       handlers.Scoring
+	metrics       evalMetrics
+}
+
+// runEval implements the "eval" subcommand: it runs the queries of a query set against an index built from -file,
+// and measures the relevance of the rankings against the judgments of a TREC qrels file with P@k, recall, MAP,
+// MRR and nDCG@k. Every scoring formula of -scorers is evaluated, on the index configured by the flags and,
+// with -variant, on a second index configured by the variant flags, and the runs are printed side by side.
+// Parameters:
+//
+//	args: the command-line arguments following the subcommand.
+func runEval(args []string) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return
+	}
+	if err := eval(os.Stdout, evalConfig, benchConfig.topK); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// eval evaluates every configuration and scoring formula, and writes the comparison table.
+func eval(w io.Writer, config evalOptions, k int) error {
+	if config.qrels == "" || config.topics == "" || searchFilePath == "" {
+		return fmt.Errorf("usage: ./yourApp eval -file <path_to_xml_file> -qrels <qrels> -topics <topics> [-scorers tfidf,bm25] [-variant <flags>]")
+	}
+	if k < 1 {
+		return fmt.Errorf("-k must be at least 1")
+	}
+	qrels, err := readQrels(config.qrels)
+	if err != nil {
+		return err
+	}
+	topics, err := readTopics(config.topics)
+	if err != nil {
+		return err
+	}
+	var scorings []handlers.Scoring
+	for _, name := range strings.Split(config.scorers, ",") {
+		scoring, err := parseScoring(strings.TrimSpace(name))
+		if err != nil {
+			return err
+		}
+		scorings = append(scorings, scoring)
+	}
+
+	// Evaluate the configuration of the flags, then the variant, which is applied on top of it.
+	configurations := []string{"base"}
+	settings := []engineSettings{engineConfig}
+	if config.variant != "" {
+		variant, err := engineConfig.withVariant(config.variant)
+		if err != nil {
+			return err
+		}
+		configurations = append(configurations, config.variant)
+		settings = append(settings, variant)
+	}
+	var runs []evalRun
+	for i, configuration := range configurations {
+		engine, err := loadEngine(searchFilePath, settings[i])
+		if err != nil {
+			return err
+		}
+		engine.Cache = nil // Results are scored differently by every scoring formula.
+		judgments := resolveQrels(engine, qrels)
+		for _, scoring := range scorings {
+			engine.Scoring = scoring
+			metrics, err := evaluate(engine, topics, judgments, k)
+			if err != nil {
+				return err
+			}
+			runs = append(runs, evalRun{configuration: configuration, scoring: scoring, metrics: metrics})
+		}
+	}
+	printRuns(w, runs, k)
+	return nil
+}
+
+// readQrels reads a TREC qrels file: "topic iteration document relevance" lines, where the document is
+// a document ID, URL or title and the relevance is 0 for non-relevant documents and graded above.
+// It returns the relevance of the judged documents of every topic.
+func readQrels(path string) (map[string]map[string]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	qrels := make(map[string]map[string]int)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("%s:%d: expected \"topic iteration document relevance\"", path, line)
+		}
+		relevance, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid relevance %q", path, line, fields[len(fields)-1])
+		}
+		// Titles may contain spaces: the document is everything between the iteration and the relevance.
+		document := strings.Join(fields[2:len(fields)-1], " ")
+		if qrels[fields[0]] == nil {
+			qrels[fields[0]] = make(map[string]int)
+		}
+		qrels[fields[0]][document] = relevance
+	}
+	return qrels, scanner.Err()
+}
+
+// readTopics reads the query set: "topic query" lines, where the query is everything after the topic.
+func readTopics(path string) ([]evalTopic, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var topics []evalTopic
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, query, ok := strings.Cut(strings.Replace(text, "\t", " ", 1), " ")
+		if !ok || strings.TrimSpace(query) == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"topic query\"", path, line)
+		}
+		topics = append(topics, evalTopic{id: id, query: strings.TrimSpace(query)})
+	}
+	return topics, scanner.Err()
+}
+
+// resolveQrels maps the judged documents of every topic to the IDs of the documents of the engine,
+// looking them up by ID, then URL, then title. Documents missing from the index are dropped.
+func resolveQrels(engine *handlers.SearchEngine, qrels map[string]map[string]int) map[string]map[int]int {
+	byURL := make(map[string]int)
+	byTitle := make(map[string]int)
+	for _, doc := range engine.Documents {
+		byURL[doc.URL] = doc.ID
+		byTitle[doc.Title] = doc.ID
+	}
+	judgments := make(map[string]map[int]int)
+	for topic, documents := range qrels {
+		judgments[topic] = make(map[int]int)
+		for document, relevance := range documents {
+			id, err := strconv.Atoi(document)
+			if err != nil || id < 0 || id >= len(engine.Documents) {
+				var ok bool
+				if id, ok = byURL[document]; !ok {
+					if id, ok = byTitle[document]; !ok {
+						continue
+					}
+				}
+			}
+			judgments[topic][id] = relevance
+		}
+	}
+	return judgments
+}
+
+// evaluate runs every topic with judged relevant documents and averages the relevance metrics of the rankings.
+// Topics without relevant documents are skipped, as in trec_eval.
+func evaluate(engine *handlers.SearchEngine, topics []evalTopic, judgments map[string]map[int]int, k int) (evalMetrics, error) {
+	var total evalMetrics
+	for _, topic := range topics {
+		relevance := judgments[topic.id]
+		relevant := 0
+		for _, grade := range relevance {
+			if grade > 0 {
+				relevant++
+			}
+		}
+		if relevant == 0 {
+			continue
+		}
+		result, err := runQuery(context.Background(), engine, queryModeOf(topic.query), topic.query)
+		if err != nil {
+			return evalMetrics{}, fmt.Errorf("topic %s: %w", topic.id, err)
+		}
+		m := rankingMetrics(result.IDs(), relevance, relevant, k)
+		total.topics++
+		total.precision += m.precision
+		total.recall += m.recall
+		total.ap += m.ap
+		total.rr += m.rr
+		total.ndcg += m.ndcg
+	}
+	if total.topics > 0 {
+		n := float64(total.topics)
+		total.precision /= n
+		total.recall /= n
+		total.ap /= n
+		total.rr /= n
+		total.ndcg /= n
+	}
+	return total, nil
+}
+
+// rankingMetrics computes the relevance metrics of a ranking for a topic.
+// Parameters:
+//
+//	ranking: the IDs of the retrieved documents, best first.
+//	relevance: the relevance grade of the judged documents; unjudged documents are not relevant.
+//	relevant: the number of judged documents with a positive grade.
+//	k: the rank cutoff of the precision and the nDCG.
+//
+// Return values:
+//
+//	evalMetrics: the metrics of the ranking.
+func rankingMetrics(ranking []int, relevance map[int]int, relevant int, k int) evalMetrics {
+	var m evalMetrics
+	found := 0
+	dcg := 0.0
+	for i, docID := range ranking {
+		grade := relevance[docID]
+		if grade <= 0 {
+			continue
+		}
+		found++
+		m.ap += float64(found) / float64(i+1)
+		if found == 1 {
+			m.rr = 1 / float64(i+1)
+		}
+		if i < k {
+			m.precision++
+			dcg += gain(grade, i)
+		}
+	}
+	m.precision /= float64(k)
+	m.recall = float64(found) / float64(relevant)
+	m.ap /= float64(relevant)
+
+	// The ideal ranking lists the judged documents from the most to the least relevant.
+	var grades []int
+	for _, grade := range relevance {
+		if grade > 0 {
+			grades = append(grades, grade)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(grades)))
+	ideal := 0.0
+	for i, grade := range grades[:min(k, len(grades))] {
+		ideal += gain(grade, i)
+	}
+	if ideal > 0 {
+		m.ndcg = dcg / ideal
+	}
+	return m
+}
+
+// gain returns the discounted gain of a document with the given relevance grade at the zero-based rank.
+func gain(grade int, rank int) float64 {
+	return (math.Pow(2, float64(grade)) - 1) / math.Log2(float64(rank+2))
+}
+
+// printRuns writes the metrics of every run as a table, followed by the change of every run from the first one.
+func printRuns(w io.Writer, runs []evalRun, k int) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "configuration\tscoring\ttopics\tP@%d\trecall\tMAP\tMRR\tnDCG@%d\n", k, k)
+	for i, run := range runs {
+		m := run.metrics
+		fmt.Fprintf(table, "%s\t%s\t%d\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f\n",
+			run.configuration, run.scoring, m.topics, m.precision, m.recall, m.ap, m.rr, m.ndcg)
+		if i > 0 {
+			base := runs[0].metrics
+			fmt.Fprintf(table, "\t\t\t%+.4f\t%+.4f\t%+.4f\t%+.4f\t%+.4f\n",
+				m.precision-base.precision, m.recall-base.recall, m.ap-base.ap, m.rr-base.rr, m.ndcg-base.ndcg)
+		}
+	}
+	table.Flush()
+}
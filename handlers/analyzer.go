@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	snowballeng "github.com/kljensen/snowball/english"
+	snowballfr "github.com/kljensen/snowball/french"
+	snowballhu "github.com/kljensen/snowball/hungarian"
+	snowballno "github.com/kljensen/snowball/norwegian"
+	snowballru "github.com/kljensen/snowball/russian"
+	snowballes "github.com/kljensen/snowball/spanish"
+	snowballsv "github.com/kljensen/snowball/swedish"
+)
+
+// Token is a single term produced by an Analyzer.
+// Position is the index of the token in the stream produced by the tokenizer; filters that remove
+// tokens keep the positions of the remaining ones, so removed tokens leave a gap.
+// Start and End are the byte offsets of the token in the analyzed text.
+// Stop is set on stop words by the stop word filter; the SearchEngine decides whether they are kept.
+// Type is empty for words and names the filter-made kind of token otherwise, such as "gram" or "shingle".
+type Token struct {
+	Term     string
+	Position int
+	Start    int
+	End      int
+	Stop     bool
+	Type     string
+}
+
+// Tokenizer splits text into a stream of tokens.
+type Tokenizer interface {
+	Tokenize(text string) []Token
+}
+
+// TokenizerFunc adapts an ordinary function to the Tokenizer interface.
+type TokenizerFunc func(text string) []Token
+
+// Tokenize calls f(text).
+func (f TokenizerFunc) Tokenize(text string) []Token {
+	return f(text)
+}
+
+// TokenFilter transforms a token stream. Filters are chained after a Tokenizer in a Pipeline.
+type TokenFilter interface {
+	Name() string
+	Filter(tokens []Token) []Token
+}
+
+// tokenFilter is a named function implementing TokenFilter.
+type tokenFilter struct {
+	name string
+	fn   func(tokens []Token) []Token
+}
+
+// NewTokenFilter returns a TokenFilter with the given name that applies fn to the token stream.
+func NewTokenFilter(name string, fn func(tokens []Token) []Token) TokenFilter {
+	return tokenFilter{name: name, fn: fn}
+}
+
+// Name returns the name of the filter.
+func (f tokenFilter) Name() string {
+	return f.name
+}
+
+// Filter applies the filter function to the token stream.
+func (f tokenFilter) Filter(tokens []Token) []Token {
+	return f.fn(tokens)
+}
+
+// Analyzer turns text into the tokens stored in, or looked up from, the Index.
+// Documents and queries of an index must be analyzed with the same Analyzer.
+type Analyzer interface {
+	Analyze(text string) []Token
+}
+
+// Pipeline is an Analyzer made of a Tokenizer followed by a chain of TokenFilters.
+type Pipeline struct {
+	Tokenizer Tokenizer
+	Filters   []TokenFilter
+	config    *AnalyzerConfig // Configuration the pipeline was built from by NewAnalyzer, with its defaults resolved.
+}
+
+// describeAnalyzer returns a description of the terms the analyzer emits, for the fingerprint of the options of an index:
+// the stages and the configuration of a Pipeline, or the type of another Analyzer.
+func describeAnalyzer(a Analyzer) string {
+	p, ok := a.(*Pipeline)
+	if !ok {
+		return fmt.Sprintf("%T", a)
+	}
+	names := make([]string, len(p.Filters))
+	for i, filter := range p.Filters {
+		names[i] = filter.Name()
+	}
+	description := strings.Join(names, ",")
+	if p.config != nil {
+		// Stop word sets are printed sorted.
+		description += fmt.Sprintf(" %+v", *p.config)
+	}
+	return description
+}
+
+// Analyze tokenizes the text and runs the tokens through every filter in order.
+func (p *Pipeline) Analyze(text string) []Token {
+	tokens := p.Tokenizer.Tokenize(text)
+	for _, filter := range p.Filters {
+		tokens = filter.Filter(tokens)
+	}
+	return tokens
+}
+
+// AnalysisStage is the token stream produced by a stage of an analyzer, as returned by Trace.
+type AnalysisStage struct {
+	Name   string  // Name of the stage: "tokenize" or the name of a TokenFilter.
+	Tokens []Token // Tokens after the stage.
+}
+
+// Trace analyzes the text like Analyze and returns the token stream after the tokenizer and after every filter.
+func (p *Pipeline) Trace(text string) []AnalysisStage {
+	tokens := p.Tokenizer.Tokenize(text)
+	stages := []AnalysisStage{{Name: "tokenize", Tokens: tokens}}
+	for _, filter := range p.Filters {
+		// Filters may reuse the slice they are given, so every stage keeps its own copy.
+		tokens = filter.Filter(append([]Token(nil), tokens...))
+		stages = append(stages, AnalysisStage{Name: filter.Name(), Tokens: tokens})
+	}
+	return stages
+}
+
+// TraceAnalysis returns the token stream of the text after every stage of the analyzer of the SearchEngine.
+// Analyzers other than a Pipeline are shown as a single "analyze" stage.
+// Stop words are flagged by the stop word filter and only dropped by the SearchEngine, so a last "index" stage
+// shows the tokens stored in the Index, once stop words are dropped and index-time synonyms injected.
+// Parameters:
+//
+//	text: the text to analyze, as a document would be.
+//
+// Return values:
+//
+//	[]AnalysisStage: the token stream after every stage, in order.
+func (s *SearchEngine) TraceAnalysis(text string) []AnalysisStage {
+	var stages []AnalysisStage
+	if pipeline, ok := s.Analyzer.(*Pipeline); ok {
+		stages = pipeline.Trace(text)
+	} else {
+		stages = []AnalysisStage{{Name: "analyze", Tokens: s.Analyzer.Analyze(text)}}
+	}
+	words, shingles := s.analyzeWithShingles(text, indexMode)
+	return append(stages, AnalysisStage{Name: "index", Tokens: append(words, shingles...)})
+}
+
+// String formats the stage as its name followed by every token with its position and byte offsets,
+// e.g. "stemmer: run@0[0:7] the@1[8:11](stop)".
+func (stage AnalysisStage) String() string {
+	var b strings.Builder
+	b.WriteString(stage.Name + ":")
+	for _, token := range stage.Tokens {
+		fmt.Fprintf(&b, " %s@%d[%d:%d]", token.Term, token.Position, token.Start, token.End)
+		if token.Stop {
+			b.WriteString("(stop)")
+		}
+		if token.Type != "" {
+			b.WriteString("(" + token.Type + ")")
+		}
+	}
+	return b.String()
+}
+
+// snowballStemmers maps the languages supported by the Snowball stemmers to their Stem function.
+var snowballStemmers = map[string]func(word string, stemStopWords bool) string{
+	"english":   snowballeng.Stem,
+	"french":    snowballfr.Stem,
+	"german":    germanStem,
+	"hungarian": snowballhu.Stem,
+	"norwegian": snowballno.Stem,
+	"russian":   snowballru.Stem,
+	"spanish":   snowballes.Stem,
+	"swedish":   snowballsv.Stem,
+}
+
+// Languages returns the names of the languages NewAnalyzer accepts, sorted alphabetically.
+// Besides the languages of the Snowball stemmers, "cjk" indexes Chinese, Japanese and Korean text as character n-grams.
+func Languages() []string {
+	languages := []string{"cjk"}
+	for language := range snowballStemmers {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Stemmers returns the names of the stemmers NewAnalyzer accepts:
+//
+//   - none: terms are indexed as they are, for exact matching.
+//   - snowball: the Snowball stemmer of the language (the default).
+//   - porter2: the English Porter2 stemmer, the same as the Snowball stemmer of English. English only.
+//   - minimal: a light English stemmer that only removes plural endings, so "universal" and "university" stay apart.
+//     English only.
+func Stemmers() []string {
+	return []string{"none", "snowball", "porter2", "minimal"}
+}
+
+// AnalyzerConfig selects and tunes one of the built-in analyzers.
+type AnalyzerConfig struct {
+	Language         string      // Language of the text, one of Languages. Defaults to english.
+	Stemmer          string      // Stemmer of the text, one of Stemmers. Defaults to snowball.
+	NormalizeNumbers bool        // Normalize numeric tokens with numberFilter.
+	StopWords        StopWordSet // Stop words of the text. Defaults to the built-in list of the language.
+	NGramMin         int         // Smallest character n-gram terms are split into. Defaults to 1 when NGramMax is set.
+	NGramMax         int         // Largest character n-gram terms are split into, or 0 to keep terms whole.
+	Shingles         int         // Largest word shingle to add, e.g. 2 for "new york", or 0 for none.
+}
+
+// NewAnalyzer returns the built-in analyzer described by config.
+// Parameters:
+//
+//	config: the language and options of the analyzer.
+//
+// Return values:
+//
+//	Analyzer: the analyzer for the configuration.
+//	error: an error if the language or the stemmer is not supported, the stemmer is English-only and the language
+//	       is not English, or the n-gram sizes are negative or out of order.
+func NewAnalyzer(config AnalyzerConfig) (Analyzer, error) {
+	language := strings.ToLower(config.Language)
+	if language == "" {
+		language = "english"
+	}
+	stem, ok := snowballStemmers[language]
+	if !ok && language != "cjk" {
+		return nil, fmt.Errorf("unsupported language %q, expected one of %s", language, strings.Join(Languages(), ", "))
+	}
+	if config.NGramMin < 0 || config.NGramMax < 0 || (config.NGramMax > 0 && config.NGramMin > config.NGramMax) {
+		return nil, fmt.Errorf("invalid n-gram sizes %d to %d, expected 0 <= min <= max", config.NGramMin, config.NGramMax)
+	}
+	if (config.Stemmer == "porter2" || config.Stemmer == "minimal") && language != "english" {
+		return nil, fmt.Errorf("stemmer %q only supports english, not %q", config.Stemmer, language)
+	}
+	switch config.Stemmer {
+	case "", "snowball":
+	case "porter2":
+		stem = snowballeng.Stem
+	case "minimal":
+		stem = minimalEnglishStem
+	case "none":
+		stem = nil
+	default:
+		return nil, fmt.Errorf("unsupported stemmer %q, expected one of %s", config.Stemmer, strings.Join(Stemmers(), ", "))
+	}
+	filters := []TokenFilter{
+		NewTokenFilter("normalize", normalizeFilter),
+		NewTokenFilter("lowercase", lowercaseFilter),
+	}
+	switch language {
+	case "english":
+		// Fold accents before dropping non-English characters, so "Zürich" becomes "zurich" and not "zrich".
+		filters = append(filters,
+			NewTokenFilter("fold-accents", foldAccentsFilter),
+			NewTokenFilter("non-english", removeNonEnglishFilter),
+		)
+	case "cjk":
+		filters = append(filters, NewTokenFilter("cjk-runs", cjkRunsFilter))
+	}
+	if config.NormalizeNumbers {
+		filters = append(filters, NewTokenFilter("numbers", numberFilter))
+	}
+	stopWords := config.StopWords
+	if stopWords == nil {
+		stopWords = stopWordSets[language]
+	}
+	if len(stopWords) > 0 {
+		filters = append(filters, NewTokenFilter("stopwords", stopWordFilter(stopWords)))
+	}
+	if stem != nil {
+		filters = append(filters, NewTokenFilter("stemmer", stemmerFilter(stem)))
+	}
+	if language != "english" && language != "cjk" {
+		// Other stemmers rely on diacritics, so accents are folded only once the terms are stemmed.
+		filters = append(filters, NewTokenFilter("fold-accents", foldAccentsFilter))
+	}
+	switch {
+	case language == "cjk":
+		// CJK text has no spaces between words: index every character and every pair of adjacent characters.
+		filters = append(filters, NewTokenFilter("ngrams", ngramFilter(1, 2, true)))
+	case config.NGramMax > 0:
+		filters = append(filters, NewTokenFilter("ngrams", ngramFilter(max(config.NGramMin, 1), config.NGramMax, false)))
+	}
+	if config.Shingles > 1 {
+		filters = append(filters, NewTokenFilter("shingles", shingleFilter(config.Shingles)))
+	}
+	config.Language, config.StopWords = language, stopWords
+	if config.Stemmer == "" {
+		config.Stemmer = "snowball"
+	}
+	return &Pipeline{Tokenizer: TokenizerFunc(tokenize), Filters: filters, config: &config}, nil
+}
+
+// NewEnglishAnalyzer returns the default analyzer: Unicode tokenization and normalization, lowercase filtering,
+// accent folding, removal of non-English characters, English stop word filtering and Snowball English stemming.
+func NewEnglishAnalyzer() Analyzer {
+	analyzer, _ := NewAnalyzer(AnalyzerConfig{Language: "english"})
+	return analyzer
+}
+
+// analysisMode tells the SearchEngine what kind of text it analyzes, which decides whether stop words are kept.
+type analysisMode int
+
+const (
+	indexMode  analysisMode = iota // Document text, as stored in the Index.
+	queryMode                      // Terms of a regular query, where stop words are always skipped.
+	phraseMode                     // Terms inside a quoted phrase, where indexed stop words are kept.
+)
+
+// analyzeTokens runs the text through the analyzer of the SearchEngine and drops the stop words the mode does not keep.
+// Stop words are kept in documents and phrases only when the SearchEngine indexes them.
+// With index-time synonym expansion, the synonyms of document terms are injected as a last stage.
+func (s *SearchEngine) analyzeTokens(text string, mode analysisMode) []Token {
+	words, _ := s.analyzeWithShingles(text, mode)
+	return words
+}
+
+// analyzeWithShingles is analyzeTokens returning the word shingles of the text separately from its other tokens.
+func (s *SearchEngine) analyzeWithShingles(text string, mode analysisMode) (words []Token, shingles []Token) {
+	words, shingles = splitShingles(s.dropStopWords(s.Analyzer.Analyze(text), mode))
+	if mode == indexMode && s.Synonyms != nil && s.SynonymExpansion == IndexTimeSynonyms {
+		words = s.Synonyms.Inject(words)
+	}
+	return words, shingles
+}
+
+// analyze runs the text through the analyzer of the SearchEngine and returns the resulting terms.
+func (s *SearchEngine) analyze(text string, mode analysisMode) []string {
+	return tokenTerms(s.analyzeTokens(text, mode))
+}
+
+// analyzeExact runs the text through the exact (unstemmed) analyzer of the SearchEngine and returns the resulting terms.
+// Without an exact analyzer, it falls back to the main analyzer.
+func (s *SearchEngine) analyzeExact(text string, mode analysisMode) []string {
+	return tokenTerms(s.analyzeExactTokens(text, mode))
+}
+
+// analyzeExactTokens is analyzeExact returning the tokens rather than their terms.
+func (s *SearchEngine) analyzeExactTokens(text string, mode analysisMode) []Token {
+	if s.ExactAnalyzer == nil {
+		return s.analyzeTokens(text, mode)
+	}
+	words, _ := splitShingles(s.dropStopWords(s.ExactAnalyzer.Analyze(text), mode))
+	return words
+}
+
+// dropStopWords removes the stop words the analysis mode does not keep.
+func (s *SearchEngine) dropStopWords(tokens []Token, mode analysisMode) []Token {
+	keepStopWords := s.IndexStopWords && mode != queryMode
+	r := tokens[:0]
+	for _, token := range tokens {
+		if !token.Stop || keepStopWords {
+			r = append(r, token)
+		}
+	}
+	return r
+}
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"math/bits"
+	"slices"
+	"sort"
+)
+
+// arrayContainerMax is the cardinality above which a bitmap container switches from a sorted
+// array of 16-bit values to a fixed 8KB bitset, as in Roaring bitmaps.
+const arrayContainerMax = 4096
+
+// bitsetWords is the number of 64-bit words needed to cover one 2^16 container.
+const bitsetWords = 1 << 16 / 64
+
+// Bitmap is a Roaring-style compressed bitmap of document IDs.
+// IDs are split into chunks of 2^16 by their high bits; every chunk is stored in a container
+// that is either a sorted array (sparse chunks) or a bitset (dense chunks).
+// Document IDs must fit in 32 bits.
+type Bitmap struct {
+	keys       []uint16     // High 16 bits of the IDs stored in each container, sorted.
+	containers []*container // Containers aligned with keys.
+}
+
+// container holds the low 16 bits of the IDs of one chunk.
+// Exactly one of array or bitset is in use at a time.
+type container struct {
+	array  []uint16 // Sorted values, used while the container is sparse.
+	bitset []uint64 // Bitset of bitsetWords words, used once the container is dense.
+	n      int      // Cardinality of the container.
+}
+
+// BitmapOf returns a Bitmap containing the given sorted document IDs.
+func BitmapOf(ids []int) *Bitmap {
+	b := &Bitmap{}
+	for _, id := range ids {
+		b.Add(id)
+	}
+	return b
+}
+
+// Add inserts the document ID x into the bitmap.
+func (b *Bitmap) Add(x int) {
+	key, low := uint16(x>>16), uint16(x)
+	i := b.find(key)
+	if i == len(b.keys) || b.keys[i] != key {
+		// Insert a new container for key at position i.
+		b.keys = append(b.keys, 0)
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+		b.containers = append(b.containers, nil)
+		copy(b.containers[i+1:], b.containers[i:])
+		b.containers[i] = &container{}
+	}
+	b.containers[i].add(low)
+}
+
+// Contains reports whether the document ID x is in the bitmap.
+func (b *Bitmap) Contains(x int) bool {
+	key := uint16(x >> 16)
+	i := b.find(key)
+	if i == len(b.keys) || b.keys[i] != key {
+		return false
+	}
+	return b.containers[i].contains(uint16(x))
+}
+
+// Cardinality returns the number of document IDs in the bitmap.
+func (b *Bitmap) Cardinality() int {
+	n := 0
+	for _, c := range b.containers {
+		n += c.n
+	}
+	return n
+}
+
+// Rank returns the number of document IDs of the bitmap smaller than x.
+func (b *Bitmap) Rank(x int) int {
+	key, low := uint16(x>>16), uint16(x)
+	i := b.find(key)
+	n := 0
+	for _, c := range b.containers[:i] {
+		n += c.n
+	}
+	if i < len(b.keys) && b.keys[i] == key {
+		n += b.containers[i].rank(low)
+	}
+	return n
+}
+
+// ToSlice returns the document IDs of the bitmap as a sorted slice.
+func (b *Bitmap) ToSlice() []int {
+	r := make([]int, 0, b.Cardinality())
+	for i, c := range b.containers {
+		high := int(b.keys[i]) << 16
+		c.forEach(func(low uint16) {
+			r = append(r, high|int(low))
+		})
+	}
+	return r
+}
+
+// And returns a new bitmap holding the IDs present in both b and o.
+func (b *Bitmap) And(o *Bitmap) *Bitmap {
+	r := &Bitmap{}
+	var i, j int
+	for i < len(b.keys) && j < len(o.keys) {
+		if b.keys[i] < o.keys[j] {
+			i++
+		} else if b.keys[i] > o.keys[j] {
+			j++
+		} else {
+			if c := b.containers[i].and(o.containers[j]); c.n > 0 {
+				r.keys = append(r.keys, b.keys[i])
+				r.containers = append(r.containers, c)
+			}
+			i++
+			j++
+		}
+	}
+	return r
+}
+
+// Or returns a new bitmap holding the IDs present in b, o or both.
+func (b *Bitmap) Or(o *Bitmap) *Bitmap {
+	r := &Bitmap{}
+	var i, j int
+	for i < len(b.keys) || j < len(o.keys) {
+		switch {
+		case j == len(o.keys) || (i < len(b.keys) && b.keys[i] < o.keys[j]):
+			r.keys = append(r.keys, b.keys[i])
+			r.containers = append(r.containers, b.containers[i].clone())
+			i++
+		case i == len(b.keys) || b.keys[i] > o.keys[j]:
+			r.keys = append(r.keys, o.keys[j])
+			r.containers = append(r.containers, o.containers[j].clone())
+			j++
+		default:
+			r.keys = append(r.keys, b.keys[i])
+			r.containers = append(r.containers, b.containers[i].or(o.containers[j]))
+			i++
+			j++
+		}
+	}
+	return r
+}
+
+// orWith adds the IDs of o to the bitmap in place. Containers that receive IDs are left as bitsets once they
+// are converted, even if sparse, so a union of many bitmaps converts each container once; call shrink on them
+// when done.
+func (b *Bitmap) orWith(o *Bitmap) {
+	for j, key := range o.keys {
+		i := b.find(key)
+		if i == len(b.keys) || b.keys[i] != key {
+			b.keys = slices.Insert(b.keys, i, key)
+			b.containers = slices.Insert(b.containers, i, o.containers[j].clone())
+			continue
+		}
+		b.containers[i].orWith(o.containers[j])
+	}
+}
+
+// AndNot returns a new bitmap holding the IDs present in b but not in o.
+func (b *Bitmap) AndNot(o *Bitmap) *Bitmap {
+	r := &Bitmap{}
+	j := 0
+	for i, key := range b.keys {
+		for j < len(o.keys) && o.keys[j] < key {
+			j++
+		}
+		c := b.containers[i].clone()
+		if j < len(o.keys) && o.keys[j] == key {
+			c = c.andNot(o.containers[j])
+		}
+		if c.n > 0 {
+			r.keys = append(r.keys, key)
+			r.containers = append(r.containers, c)
+		}
+	}
+	return r
+}
+
+// find returns the index of the container for key, or the index at which it would be inserted.
+func (b *Bitmap) find(key uint16) int {
+	// Documents are indexed in ID order, so the last container is by far the most common target.
+	if n := len(b.keys); n > 0 && b.keys[n-1] <= key {
+		if b.keys[n-1] == key {
+			return n - 1
+		}
+		return n
+	}
+	return sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= key })
+}
+
+// add inserts low into the container, converting it to a bitset once it becomes dense.
+func (c *container) add(low uint16) {
+	if c.bitset != nil {
+		if c.bitset[low/64]&(1<<(low%64)) == 0 {
+			c.bitset[low/64] |= 1 << (low % 64)
+			c.n++
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= low })
+	if i < len(c.array) && c.array[i] == low {
+		return
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = low
+	c.n++
+	if c.n > arrayContainerMax {
+		c.toBitset()
+	}
+}
+
+// contains reports whether low is in the container.
+func (c *container) contains(low uint16) bool {
+	if c.bitset != nil {
+		return c.bitset[low/64]&(1<<(low%64)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= low })
+	return i < len(c.array) && c.array[i] == low
+}
+
+// rank returns the number of values of the container smaller than low.
+func (c *container) rank(low uint16) int {
+	if c.bitset == nil {
+		return sort.Search(len(c.array), func(i int) bool { return c.array[i] >= low })
+	}
+	n := 0
+	for _, word := range c.bitset[:low/64] {
+		n += bits.OnesCount64(word)
+	}
+	return n + bits.OnesCount64(c.bitset[low/64]&(1<<(low%64)-1))
+}
+
+// forEach calls fn for every value of the container in ascending order.
+func (c *container) forEach(fn func(low uint16)) {
+	if c.bitset == nil {
+		for _, v := range c.array {
+			fn(v)
+		}
+		return
+	}
+	for w, word := range c.bitset {
+		for word != 0 {
+			t := bits.TrailingZeros64(word)
+			fn(uint16(w*64 + t))
+			word &= word - 1
+		}
+	}
+}
+
+// and returns the intersection of two containers, choosing the algorithm by their representation.
+func (c *container) and(o *container) *container {
+	switch {
+	case c.bitset != nil && o.bitset != nil:
+		r := &container{bitset: make([]uint64, bitsetWords)}
+		for i := range r.bitset {
+			r.bitset[i] = c.bitset[i] & o.bitset[i]
+			r.n += bits.OnesCount64(r.bitset[i])
+		}
+		r.shrink()
+		return r
+	case c.bitset != nil:
+		return o.filter(c, true)
+	case o.bitset != nil:
+		return c.filter(o, true)
+	}
+	r := &container{}
+	var i, j int
+	for i < len(c.array) && j < len(o.array) {
+		if c.array[i] < o.array[j] {
+			i++
+		} else if c.array[i] > o.array[j] {
+			j++
+		} else {
+			r.array = append(r.array, c.array[i])
+			i++
+			j++
+		}
+	}
+	r.n = len(r.array)
+	return r
+}
+
+// or returns the union of two containers, choosing the algorithm by their representation.
+func (c *container) or(o *container) *container {
+	if c.bitset == nil && o.bitset == nil && c.n+o.n <= arrayContainerMax {
+		r := &container{array: make([]uint16, 0, c.n+o.n)}
+		var i, j int
+		for i < len(c.array) || j < len(o.array) {
+			switch {
+			case j == len(o.array) || (i < len(c.array) && c.array[i] < o.array[j]):
+				r.array = append(r.array, c.array[i])
+				i++
+			case i == len(c.array) || c.array[i] > o.array[j]:
+				r.array = append(r.array, o.array[j])
+				j++
+			default:
+				r.array = append(r.array, c.array[i])
+				i++
+				j++
+			}
+		}
+		r.n = len(r.array)
+		return r
+	}
+	r := c.clone()
+	r.toBitset()
+	if o.bitset != nil {
+		r.n = 0
+		for i := range r.bitset {
+			r.bitset[i] |= o.bitset[i]
+			r.n += bits.OnesCount64(r.bitset[i])
+		}
+	} else {
+		for _, v := range o.array {
+			r.add(v)
+		}
+	}
+	r.shrink()
+	return r
+}
+
+// orWith adds the values of o to the container in place.
+func (c *container) orWith(o *container) {
+	if c.bitset == nil && o.bitset == nil && c.n+o.n <= arrayContainerMax {
+		*c = *c.or(o)
+		return
+	}
+	c.toBitset()
+	if o.bitset == nil {
+		for _, v := range o.array {
+			c.add(v)
+		}
+		return
+	}
+	c.n = 0
+	for i := range c.bitset {
+		c.bitset[i] |= o.bitset[i]
+		c.n += bits.OnesCount64(c.bitset[i])
+	}
+}
+
+// andNot returns the values of c that are not in o, choosing the algorithm by their representation.
+func (c *container) andNot(o *container) *container {
+	if c.bitset == nil {
+		return c.filter(o, false)
+	}
+	r := c.clone()
+	r.n = 0
+	for i := range r.bitset {
+		if o.bitset != nil {
+			r.bitset[i] &^= o.bitset[i]
+		}
+		r.n += bits.OnesCount64(r.bitset[i])
+	}
+	if o.bitset == nil {
+		for _, v := range o.array {
+			if r.bitset[v/64]&(1<<(v%64)) != 0 {
+				r.bitset[v/64] &^= 1 << (v % 64)
+				r.n--
+			}
+		}
+	}
+	r.shrink()
+	return r
+}
+
+// filter returns the values of the array container c whose membership in o equals keep.
+func (c *container) filter(o *container, keep bool) *container {
+	r := &container{}
+	for _, v := range c.array {
+		if o.contains(v) == keep {
+			r.array = append(r.array, v)
+		}
+	}
+	r.n = len(r.array)
+	return r
+}
+
+// toBitset converts an array container to a bitset container.
+func (c *container) toBitset() {
+	if c.bitset != nil {
+		return
+	}
+	c.bitset = make([]uint64, bitsetWords)
+	for _, v := range c.array {
+		c.bitset[v/64] |= 1 << (v % 64)
+	}
+	c.array = nil
+}
+
+// shrink converts a bitset container back to an array container once it becomes sparse.
+func (c *container) shrink() {
+	if c.bitset == nil || c.n > arrayContainerMax {
+		return
+	}
+	array := make([]uint16, 0, c.n)
+	c.forEach(func(low uint16) {
+		array = append(array, low)
+	})
+	c.array, c.bitset = array, nil
+}
+
+// clone returns a deep copy of the container.
+func (c *container) clone() *container {
+	r := &container{n: c.n}
+	if c.bitset != nil {
+		r.bitset = append([]uint64(nil), c.bitset...)
+	} else {
+		r.array = append([]uint16(nil), c.array...)
+	}
+	return r
+}
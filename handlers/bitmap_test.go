@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// naiveUnion and naiveDifference compute set operations on sorted slices with a map, as references.
+func naiveUnion(a []int, b []int) []int {
+	seen := make(map[int]bool)
+	r := []int{}
+	for _, id := range append(slices.Clone(a), b...) {
+		if !seen[id] {
+			seen[id] = true
+			r = append(r, id)
+		}
+	}
+	slices.Sort(r)
+	return r
+}
+
+func naiveDifference(a []int, b []int) []int {
+	in := make(map[int]bool, len(b))
+	for _, id := range b {
+		in[id] = true
+	}
+	r := []int{}
+	for _, id := range a {
+		if !in[id] {
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+func TestBitmap(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	// Enough IDs below 2^16 to switch the first container to a bitset, and a sparse tail over several containers.
+	ids := append(randomIDs(r, 6000, 1<<16), randomIDs(r, 300, 1<<20)...)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	b := BitmapOf(ids)
+	if got := b.ToSlice(); !slices.Equal(got, ids) {
+		t.Fatalf("ToSlice() returned %d IDs, want %d", len(got), len(ids))
+	}
+	if got := b.Cardinality(); got != len(ids) {
+		t.Errorf("Cardinality() = %d, want %d", got, len(ids))
+	}
+	for i, id := range ids {
+		if !b.Contains(id) {
+			t.Fatalf("Contains(%d) = false", id)
+		}
+		if got := b.Rank(id); got != i {
+			t.Fatalf("Rank(%d) = %d, want %d", id, got, i)
+		}
+	}
+	if b.Contains(1<<20 + 1) {
+		t.Errorf("Contains(%d) = true for an absent ID", 1<<20+1)
+	}
+}
+
+func TestSetOperationsAcrossRepresentations(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	sets := [][]int{
+		{},
+		randomIDs(r, 5, 200000),
+		randomIDs(r, 2000, 200000),
+		randomIDs(r, 9000, 70000), // Dense enough for bitset containers.
+		randomIDs(r, 100000, 200000),
+	}
+	// list returns the IDs as a sparse posting list, or as a bitmap one.
+	list := func(ids []int, bitmap bool) *PostingList {
+		if bitmap {
+			return &PostingList{bitmap: BitmapOf(ids)}
+		}
+		return NewPostingList(ids)
+	}
+	for _, a := range sets {
+		for _, b := range sets {
+			and, or, andNot := naiveIntersection(a, b), naiveUnion(a, b), naiveDifference(a, b)
+			for _, aBitmap := range []bool{false, true} {
+				for _, bBitmap := range []bool{false, true} {
+					x, y := list(a, aBitmap), list(b, bBitmap)
+					if got := Intersection(x, y).IDs(); !slices.Equal(got, and) {
+						t.Errorf("Intersection(%d ids bitmap=%v, %d ids bitmap=%v) has %d ids, want %d", len(a), aBitmap, len(b), bBitmap, len(got), len(and))
+					}
+					if got := Union(x, y).IDs(); !slices.Equal(got, or) {
+						t.Errorf("Union(%d ids bitmap=%v, %d ids bitmap=%v) has %d ids, want %d", len(a), aBitmap, len(b), bBitmap, len(got), len(or))
+					}
+					if got := Difference(x, y).IDs(); !slices.Equal(got, andNot) {
+						t.Errorf("Difference(%d ids bitmap=%v, %d ids bitmap=%v) has %d ids, want %d", len(a), aBitmap, len(b), bBitmap, len(got), len(andNot))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestUnionAll(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	for _, bitmaps := range []int{0, 1, 4} {
+		var lists []*PostingList
+		want := []int{}
+		for i := range 9 {
+			ids := randomIDs(r, 1+r.Intn(6000), 300000)
+			want = naiveUnion(want, ids)
+			if i < bitmaps {
+				lists = append(lists, &PostingList{bitmap: BitmapOf(ids)})
+			} else {
+				lists = append(lists, NewPostingList(ids))
+			}
+		}
+		if got := unionAll(lists).IDs(); !slices.Equal(got, want) {
+			t.Errorf("unionAll of 9 lists with %d bitmaps has %d ids, want %d", bitmaps, len(got), len(want))
+		}
+	}
+	if got := unionAll(nil).Len(); got != 0 {
+		t.Errorf("unionAll(nil) has %d ids", got)
+	}
+}
+
+func TestCompactKeepsPositions(t *testing.T) {
+	p := &PostingList{}
+	for id := range 100 {
+		p.add(id, id%7)
+		p.add(id, 20)
+	}
+	p.compact(200) // Dense within 200 documents.
+	if !p.IsBitmap() {
+		t.Fatal("compact(200) kept a sparse list for 100 documents")
+	}
+	for id := range 100 {
+		if got, want := p.Positions(id), []int{id % 7, 20}; !slices.Equal(got, want) {
+			t.Fatalf("Positions(%d) = %v, want %v", id, got, want)
+		}
+	}
+	p.compact(100000) // Sparse again.
+	if p.IsBitmap() || p.Len() != 100 || !slices.Equal(p.Positions(42), []int{0, 20}) {
+		t.Errorf("compact(100000) = bitmap %v, %d documents, positions %v", p.IsBitmap(), p.Len(), p.Positions(42))
+	}
+}
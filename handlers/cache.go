@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryCache is a least recently used cache of query results, keyed by the analyzed form of the query
+// so that queries differing only in case, spacing or word forms share an entry.
+// Entries expire after a time to live, and are ignored once the index generation they were computed
+// for is outdated. It is safe for concurrent use.
+type QueryCache struct {
+	mu      sync.Mutex
+	size    int                      // Maximum number of entries.
+	ttl     time.Duration            // Time to live of an entry, or 0 to keep entries until they are evicted.
+	entries map[string]*list.Element // Entries by key.
+	order   *list.List               // Entries from the most to the least recently used.
+	stats   CacheStats
+}
+
+// cacheEntry is a cached query result.
+type cacheEntry struct {
+	key        string
+	generation uint64 // Index generation the result was computed for.
+	expires    time.Time
+	result     *SearchResult
+}
+
+// CacheStats counts the lookups of a QueryCache.
+type CacheStats struct {
+	Hits      uint64 // Lookups answered from the cache.
+	Misses    uint64 // Lookups that ran the query, including those finding an expired or outdated entry.
+	Evictions uint64 // Entries removed to make room for new ones.
+	Entries   int    // Entries currently in the cache.
+}
+
+// NewQueryCache returns an empty QueryCache holding at most size results, each for at most ttl (0 for no limit).
+// A cache of size 0 or less holds nothing: every lookup misses.
+func NewQueryCache(size int, ttl time.Duration) *QueryCache {
+	return &QueryCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Stats returns the counters of the cache.
+func (c *QueryCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	return stats
+}
+
+// get returns the result cached for the key and the index generation, if it has not expired.
+func (c *QueryCache) get(key string, generation uint64) (*SearchResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if entry.generation != generation || (c.ttl > 0 && time.Now().After(entry.expires)) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		c.stats.Misses++
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	c.stats.Hits++
+	return entry.result, true
+}
+
+// put caches the result of the key for the index generation, evicting the least recently used entry when the cache is full.
+// It does nothing when the size of the cache is 0 or less.
+func (c *QueryCache) put(key string, generation uint64, result *SearchResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	entry := &cacheEntry{key: key, generation: generation, expires: time.Now().Add(c.ttl), result: result}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	for c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.order.PushFront(entry)
+}
+
+// cached returns the cached result of the key when the SearchEngine has a QueryCache holding it,
+// and runs the query and caches its result otherwise. Results of failed queries are not cached.
+// Cached results are shared between callers, who must not modify them; only Elapsed is set for every call.
+func (s *SearchEngine) cached(key string, run func() (*SearchResult, error)) (*SearchResult, error) {
+	if s.Cache == nil {
+		return run()
+	}
+	start := time.Now()
+	generation := s.Generation()
+	if result, ok := s.Cache.get(key, generation); ok {
+		hit := *result
+		hit.Elapsed = time.Since(start)
+		return &hit, nil
+	}
+	result, err := run()
+	if err == nil {
+		s.Cache.put(key, generation, result)
+	}
+	return result, err
+}
+
+// regularCacheKey returns the analyzed form of a regular query: its clauses with the analyzed terms of their alternatives.
+// Stop words are kept when they are indexed, since a query made only of them is then searched.
+func (s *SearchEngine) regularCacheKey(text string) string {
+	var b strings.Builder
+	b.WriteString("regular:")
+	for _, clause := range parseQuery(text) {
+		if clause.Exclude {
+			b.WriteString("-")
+		}
+		for i, alternative := range clause.Alternatives {
+			if i > 0 {
+				b.WriteString("|")
+			}
+			b.WriteString(s.termCacheKey(alternative))
+		}
+		for _, near := range clause.Near {
+			b.WriteString("~" + strconv.Itoa(near.Distance) + ":" + s.termCacheKey(near.Term))
+		}
+		b.WriteString(";")
+	}
+	return b.String()
+}
+
+// termCacheKey returns the analyzed terms of a raw query term, with a '=' prefix for exact terms.
+func (s *SearchEngine) termCacheKey(term string) string {
+	if len(term) > 1 && strings.HasPrefix(term, "=") {
+		return "=" + strings.Join(s.analyzeExact(term[1:], phraseMode), " ")
+	}
+	return strings.Join(s.analyze(term, phraseMode), " ")
+}
+
+// phraseCacheKey returns the analyzed form of a phrase query: its terms with their positions in the phrase and its slop.
+func (s *SearchEngine) phraseCacheKey(query string) string {
+	text, slop := parsePhrase(query)
+	var b strings.Builder
+	b.WriteString("phrase:" + strconv.Itoa(slop) + ":")
+	tokens := s.analyzeTokens(text, phraseMode)
+	for _, token := range tokens {
+		b.WriteString(token.Term + "@" + strconv.Itoa(token.Position-tokens[0].Position) + " ")
+	}
+	return b.String()
+}
@@ -0,0 +1,18 @@
+package handlers
+
+import "testing"
+
+func TestQueryCacheSize(t *testing.T) {
+	for _, size := range []int{-1, 0, 1, 2} {
+		cache := NewQueryCache(size, 0)
+		for i, key := range []string{"a", "b", "c"} {
+			cache.put(key, 0, &SearchResult{Total: i})
+		}
+		if got, want := cache.Stats().Entries, max(size, 0); got != want {
+			t.Errorf("cache of size %d holds %d entries, want %d", size, got, want)
+		}
+		if _, ok := cache.get("c", 0); ok != (size > 0) {
+			t.Errorf("cache of size %d: get(last key) found %v, want %v", size, ok, size > 0)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Explanation breaks down how a query was analyzed and parsed, and how it scores a document.
+// It is returned by Explain to debug rankings.
+type Explanation struct {
+	Query string // Raw query.
+	DocID int    // Explained document.
+	Mode  string // Query mode: "regular", "phrase" or "wildcard", chosen like the /search endpoint does.
+
+	Clauses  []ClauseExplanation // Parsed clauses of a regular query, after synonym expansion.
+	Phrase   []Token             // Analyzed tokens of a phrase query, with their positions in the phrase.
+	Slop     int                 // Slop of a phrase query.
+	Wildcard []string            // Index terms matching a wildcard query that the document contains.
+
+	Matched    bool             // Whether the document matches the query.
+	Components []ScoreComponent // Components of the score of a regular query, summed before the proximity boost.
+	Proximity  float64          // Proximity boost factor the summed components are multiplied by.
+	Span       int              // Smallest window holding a term of every clause, or -1 when there is none.
+	Score      float64          // Final score of the document. Phrase and wildcard matches are not scored.
+}
+
+// ClauseExplanation describes a clause of a regular query.
+type ClauseExplanation struct {
+	Clause  string   // The clause as it was parsed, e.g. "usa OR united states" or "-moon".
+	Terms   []string // Analyzed terms of the clause; exact terms are prefixed with '='.
+	Matched bool     // Whether the document contains the clause; an excluded clause that matches removes the document.
+	Skipped bool     // The clause has no indexable token, such as a stop word, and is ignored.
+}
+
+// ScoreComponent is one term of the sum of a document relevance score (TF-IDF or BM25, see Scoring).
+type ScoreComponent struct {
+	Field   string  // "text", "title" or "shingle".
+	Term    string  // Analyzed term or shingle; exact terms are prefixed with '='.
+	Count   int     // Occurrences of the term in the field.
+	Length  int     // Number of terms of the field, which normalizes the count into TF.
+	TF      float64 // Term frequency in the text: Count / Length, or its BM25 saturation. Title components reuse the text TF.
+	DocFreq int     // Number of documents containing the term.
+	IDF     float64 // Inverse document frequency: log(documents / DocFreq), or its BM25 variant.
+	Boost   float64 // Weight of the component.
+	Score   float64 // TF * IDF * Boost.
+}
+
+// add records a score component; it does nothing on a nil Explanation, so scoring code can call it unconditionally.
+func (e *Explanation) add(component ScoreComponent) {
+	if e == nil {
+		return
+	}
+	e.Components = append(e.Components, component)
+}
+
+// String returns the term as it is written in queries, with a '=' prefix for exact terms.
+func (t queryTerm) String() string {
+	if t.Exact {
+		return "=" + t.Term
+	}
+	return t.Term
+}
+
+// Explain explains how the query scores the document with the given ID.
+// The query is routed like the /search endpoint does: queries containing '"' are phrase queries,
+// queries containing '*' are wildcard queries and the others are regular queries.
+// Parameters:
+//
+//	ctx: the context of the query.
+//	query: the raw search query.
+//	docID: the ID of the document to explain.
+//
+// Return values:
+//
+//	*Explanation: the analysis of the query and the breakdown of the document score.
+//	error: an error if no document has the given ID, ErrInvalidQuery if the query cannot be evaluated,
+//	       or the error of the context if it ended first.
+func (s *SearchEngine) Explain(ctx context.Context, query string, docID int) (*Explanation, error) {
+	if docID < 0 || docID >= len(s.Documents) {
+		return nil, fmt.Errorf("no document with ID %d", docID)
+	}
+	e := &Explanation{Query: query, DocID: docID, Span: -1, Proximity: 1}
+	switch {
+	case strings.Contains(query, "\""):
+		e.Mode = "phrase"
+		text, slop := parsePhrase(query)
+		e.Phrase, e.Slop = s.analyzeTokens(text, phraseMode), slop
+		matches, err := s.phraseMatches(ctx, e.Phrase, slop)
+		if err != nil {
+			return nil, err
+		}
+		e.Matched = NewPostingList(matches).Contains(docID)
+	case strings.Contains(query, "*"):
+		e.Mode = "wildcard"
+		wildcardRegex, err := wildcardRegexp(query)
+		if err != nil {
+			return nil, err
+		}
+		i := 0
+		for token, postings := range s.Index {
+			if err := checkContext(ctx, i); err != nil {
+				return nil, err
+			}
+			i++
+			if wildcardRegex.MatchString(token) && postings.Contains(docID) {
+				e.Wildcard = append(e.Wildcard, token)
+			}
+		}
+		e.Matched = len(e.Wildcard) > 0
+	default:
+		e.Mode = "regular"
+		resolved, err := s.resolveQuery(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for i, clause := range resolved.clauses {
+			c := ClauseExplanation{Clause: clause.String(), Skipped: resolved.postings[i] == nil}
+			for _, term := range resolved.terms[i] {
+				c.Terms = append(c.Terms, term.String())
+			}
+			c.Matched = !c.Skipped && resolved.postings[i].Contains(docID)
+			e.Clauses = append(e.Clauses, c)
+		}
+		e.Matched = resolved.matches.Contains(docID)
+		if e.Matched {
+			e.Score = s.scoreDocument(resolved, docID, e)
+		}
+	}
+	return e, nil
+}
+
+// String returns the clause as it would be written in a query.
+func (c queryClause) String() string {
+	text := strings.Join(c.Alternatives, " OR ")
+	if c.Exclude {
+		text = "-" + text
+	}
+	for _, near := range c.Near {
+		text += fmt.Sprintf(" NEAR/%d %s", near.Distance, near.Term)
+	}
+	return text
+}
+
+// String formats the explanation as an indented, human-readable report.
+func (e *Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "query: %s (%s)\n", e.Query, e.Mode)
+	switch e.Mode {
+	case "phrase":
+		fmt.Fprintf(&b, "phrase tokens (slop %d):\n", e.Slop)
+		for _, token := range e.Phrase {
+			fmt.Fprintf(&b, "  %q at position %d\n", token.Term, token.Position)
+		}
+	case "wildcard":
+		fmt.Fprintf(&b, "matching terms in the document: %s\n", strings.Join(e.Wildcard, ", "))
+	default:
+		b.WriteString("clauses:\n")
+		for _, c := range e.Clauses {
+			status := "not matched"
+			switch {
+			case c.Skipped:
+				status = "skipped"
+			case c.Matched:
+				status = "matched"
+			}
+			fmt.Fprintf(&b, "  %s -> [%s] %s\n", c.Clause, strings.Join(c.Terms, " "), status)
+		}
+	}
+	if !e.Matched {
+		fmt.Fprintf(&b, "document %d: not matched\n", e.DocID)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "document %d: matched, score %.4f\n", e.DocID, e.Score)
+	for _, c := range e.Components {
+		if c.Field == "title" {
+			fmt.Fprintf(&b, "  %.4f title %q: text tf*idf %.4f * boost %.2f (%d in title)\n",
+				c.Score, c.Term, c.TF*c.IDF, c.Boost, c.Count)
+			continue
+		}
+		fmt.Fprintf(&b, "  %.4f %s %q: tf %.4f (%d/%d) * idf %.4f (df %d) * boost %.2f\n",
+			c.Score, c.Field, c.Term, c.TF, c.Count, c.Length, c.IDF, c.DocFreq, c.Boost)
+	}
+	if e.Mode == "regular" {
+		if e.Span >= 0 {
+			fmt.Fprintf(&b, "  x%.4f proximity: clause terms within %d positions\n", e.Proximity, e.Span)
+		} else {
+			fmt.Fprintf(&b, "  x%.4f proximity\n", e.Proximity)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import "strings"
+
+// germanStem is the Snowball German stemmer (https://snowballstem.org/algorithms/german/stemmer.html),
+// which the Snowball package used for the other languages does not provide. The word must be lowercase.
+// Umlauts are kept while stemming and removed from the stem, so "häuser" and "haus" share the stem "haus".
+func germanStem(word string, _ bool) string {
+	w := []rune(strings.ReplaceAll(word, "ß", "ss"))
+	// Mark u and y between vowels as consonants.
+	for i := 1; i+1 < len(w); i++ {
+		if (w[i] == 'u' || w[i] == 'y') && isGermanVowel(w[i-1]) && isGermanVowel(w[i+1]) {
+			w[i] -= 'a' - 'A'
+		}
+	}
+	r1 := germanRegion(w, 0)
+	r2 := germanRegion(w, r1)
+	r1 = max(r1, 3)
+
+	// Step 1: inflectional endings.
+	switch suffix := longestSuffix(w, "ern", "em", "er", "en", "es", "e", "s"); {
+	case suffix == "" || len(w)-len(suffix) < r1:
+	case suffix == "s":
+		if len(w) > 1 && strings.ContainsRune("bdfghklmnrt", w[len(w)-2]) {
+			w = w[:len(w)-1]
+		}
+	default:
+		w = w[:len(w)-len(suffix)]
+		if (suffix == "e" || suffix == "en" || suffix == "es") && hasSuffix(w, "niss") {
+			w = w[:len(w)-1]
+		}
+	}
+
+	// Step 2: more inflectional endings.
+	switch suffix := longestSuffix(w, "est", "en", "er", "st"); {
+	case suffix == "" || len(w)-len(suffix) < r1:
+	case suffix == "st":
+		if len(w) > 5 && strings.ContainsRune("bdfghklmnt", w[len(w)-3]) {
+			w = w[:len(w)-2]
+		}
+	default:
+		w = w[:len(w)-len(suffix)]
+	}
+
+	// Step 3: derivational endings.
+	inR1 := func(suffix string) bool { return hasSuffix(w, suffix) && len(w)-len(suffix) >= r1 }
+	inR2 := func(suffix string) bool { return hasSuffix(w, suffix) && len(w)-len(suffix) >= r2 }
+	precededByE := func(suffix string) bool { return len(w) > len(suffix) && w[len(w)-len(suffix)-1] == 'e' }
+	switch suffix := longestSuffix(w, "isch", "lich", "heit", "keit", "end", "ung", "ig", "ik"); {
+	case suffix == "" || !inR2(suffix):
+	case suffix == "end" || suffix == "ung":
+		w = w[:len(w)-len(suffix)]
+		if inR2("ig") && !precededByE("ig") {
+			w = w[:len(w)-2]
+		}
+	case suffix == "ig" || suffix == "ik" || suffix == "isch":
+		if !precededByE(suffix) {
+			w = w[:len(w)-len(suffix)]
+		}
+	case suffix == "lich" || suffix == "heit":
+		w = w[:len(w)-len(suffix)]
+		if inR1("er") || inR1("en") {
+			w = w[:len(w)-2]
+		}
+	case suffix == "keit":
+		w = w[:len(w)-len(suffix)]
+		if inR2("lich") {
+			w = w[:len(w)-4]
+		} else if inR2("ig") {
+			w = w[:len(w)-2]
+		}
+	}
+
+	for i, c := range w {
+		switch c {
+		case 'U', 'ü':
+			w[i] = 'u'
+		case 'Y':
+			w[i] = 'y'
+		case 'ä':
+			w[i] = 'a'
+		case 'ö':
+			w[i] = 'o'
+		}
+	}
+	return string(w)
+}
+
+// isGermanVowel reports whether c is a vowel of the Snowball German stemmer.
+func isGermanVowel(c rune) bool {
+	return strings.ContainsRune("aeiouyäöü", c)
+}
+
+// germanRegion returns the start of the region following the first non-vowel that follows a vowel at or after
+// from, or len(w) when there is none: R1 from the start of the word, R2 from R1.
+func germanRegion(w []rune, from int) int {
+	for i := from + 1; i < len(w); i++ {
+		if !isGermanVowel(w[i]) && isGermanVowel(w[i-1]) {
+			return i + 1
+		}
+	}
+	return len(w)
+}
+
+// longestSuffix returns the first of the suffixes, listed longest first, that ends w, or "" when none does.
+// The suffixes are ASCII, so their length in bytes is their length in runes.
+func longestSuffix(w []rune, suffixes ...string) string {
+	for _, suffix := range suffixes {
+		if hasSuffix(w, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// hasSuffix reports whether w ends with the ASCII suffix.
+func hasSuffix(w []rune, suffix string) bool {
+	if len(w) < len(suffix) {
+		return false
+	}
+	for i := range len(suffix) {
+		if w[len(w)-len(suffix)+i] != rune(suffix[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGermanStem(t *testing.T) {
+	// Examples of the Snowball German stemmer, from https://snowballstem.org/algorithms/german/stemmer.html.
+	tests := map[string]string{
+		"aufeinander":          "aufeinand",
+		"aufeinanderbiss":      "aufeinanderbiss",
+		"aufeinanderfolge":     "aufeinanderfolg",
+		"aufeinanderfolgenden": "aufeinanderfolg",
+		"aufeinanderfolgender": "aufeinanderfolg",
+		"aufeinanderfolgt":     "aufeinanderfolgt",
+		"aufeinanderfolgten":   "aufeinanderfolgt",
+		"aufeinanderschlügen":  "aufeinanderschlug",
+		"aufenthalt":           "aufenthalt",
+		"aufenthalten":         "aufenthalt",
+		"aufenthaltes":         "aufenthalt",
+		"auferlegen":           "auferleg",
+		"auferlegt":            "auferlegt",
+		"auferstanden":         "auferstand",
+		"auferstehen":          "aufersteh",
+		"aufersteht":           "aufersteht",
+		"auferstehung":         "aufersteh",
+		"kategorie":            "kategori",
+		"häuser":               "haus",
+		"straße":               "strass",
+		"bauen":                "bau",
+	}
+	for word, want := range tests {
+		if got := germanStem(word, false); got != want {
+			t.Errorf("germanStem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestGermanAnalyzer(t *testing.T) {
+	analyzer, err := NewAnalyzer(AnalyzerConfig{Language: "german"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, token := range analyzer.Analyze("Die Häuser über der Straße") {
+		if !token.Stop {
+			got = append(got, token.Term)
+		}
+	}
+	if want := []string{"haus", "strass"}; !slices.Equal(got, want) {
+		t.Errorf("Analyze() kept %v, want %v", got, want)
+	}
+}
@@ -1,14 +1,11 @@
 package handlers
 
 import (
-	"compress/gzip"
-	"encoding/xml"
-	"os"
-	"regexp"
+	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 	"unicode"
-
-	snowballeng "github.com/kljensen/snowball/english"
 )
 
 type Document struct {
@@ -16,19 +13,118 @@ type Document struct {
 	URL   string `xml:"url"`
 	Text  string `xml:"abstract"`
 	ID    int
+
+	// Links are the titles of the articles the internal links of the text point to, in order of first appearance.
+	Links []string
+
+	// Metadata of documents loaded from a MediaWiki page export; zero for abstracts.
+	PageID    int       // ID of the page in the wiki.
+	Namespace int       // Namespace of the page, 0 for articles.
+	Timestamp time.Time // Time of the revision the text was taken from.
 }
 
 type SearchEngine struct {
 	Documents []Document
-	Index     map[string][]int
+	Index     map[string]*PostingList
+	Analyzer  Analyzer // Analyzer used for both the documents and the queries.
+
+	// IndexStopWords keeps stop words in the Index. They are still skipped in regular queries,
+	// unless they appear inside a phrase or the query contains nothing else.
+	IndexStopWords bool
+
+	Synonyms         *SynonymMap      // Synonym rules, or nil to disable synonym expansion.
+	SynonymExpansion SynonymExpansion // Whether synonyms are expanded in queries or in documents.
+
+	// ExactIndex is a shadow index of unstemmed terms built with ExactAnalyzer, used by the "=term" operator.
+	// It is nil unless an exact analyzer is configured; without one, "=term" falls back to the stemmed Index.
+	ExactIndex    map[string]*PostingList
+	ExactAnalyzer Analyzer
+
+	// ShingleIndex holds the word shingles, such as "new york", emitted by an analyzer with a shingle filter.
+	// Documents containing the adjacent terms of a query get a proximity boost in Search.
+	ShingleIndex map[string]*PostingList
+
+	// Scoring is the formula ranking the documents matching a query, TF-IDF by default.
+	Scoring       Scoring
+	averageLength float64 // Average number of terms of the indexed texts, for BM25 length normalization.
+	lengths       []int   // Number of terms of the text of every document, by document ID.
+	exactLengths  []int   // Number of terms of the text of every document in the ExactIndex, when there is one.
+
+	// Cache holds the results of recent queries, or is nil to run every query.
+	// Cached results are dropped when the generation of the index changes.
+	Cache      *QueryCache
+	generation atomic.Uint64 // Incremented every time the index changes.
+
+	// CheckpointDir is the directory Ingest commits segments of SegmentSize documents to, or "" to keep the index
+	// in memory only. See WithCheckpoints.
+	CheckpointDir string
+	SegmentSize   int
+
+	progress progressTracker // Progress of the ingest, readable while the SearchEngine is being built.
 }
 
-// NewSearchEngine creates a new SearchEngine instance and initializes it with the documents loaded from the specified path.
-// It returns a pointer to the newly created SearchEngine.
-func NewSearchEngine(path string) *SearchEngine {
+// Option configures a SearchEngine created by NewSearchEngine.
+type Option func(*SearchEngine)
+
+// WithAnalyzer makes the SearchEngine analyze documents and queries with the given Analyzer
+// instead of the default English one.
+func WithAnalyzer(a Analyzer) Option {
+	return func(s *SearchEngine) {
+		s.Analyzer = a
+	}
+}
+
+// WithStopWordsIndexed makes the SearchEngine index stop words, so phrases such as "to be or not to be" can be found.
+func WithStopWordsIndexed() Option {
+	return func(s *SearchEngine) {
+		s.IndexStopWords = true
+	}
+}
+
+// WithSynonyms makes the SearchEngine expand synonyms, either in queries or in the indexed documents.
+// The synonym rules must have been analyzed with the analyzer of the SearchEngine.
+func WithSynonyms(synonyms *SynonymMap, expansion SynonymExpansion) Option {
+	return func(s *SearchEngine) {
+		s.Synonyms = synonyms
+		s.SynonymExpansion = expansion
+	}
+}
+
+// WithExactIndex makes the SearchEngine build a shadow index with the given unstemmed analyzer,
+// so "=term" queries match the term exactly rather than its stem.
+func WithExactIndex(exact Analyzer) Option {
+	return func(s *SearchEngine) {
+		s.ExactAnalyzer = exact
+		s.ExactIndex = make(map[string]*PostingList)
+	}
+}
+
+// WithQueryCache makes the SearchEngine cache the results of up to size queries, each for at most ttl (0 for no limit).
+func WithQueryCache(size int, ttl time.Duration) Option {
+	return func(s *SearchEngine) {
+		s.Cache = NewQueryCache(size, ttl)
+	}
+}
+
+// New creates an empty SearchEngine configured with the options.
+// Documents can then be loaded with LoadDocuments and indexed with IndexDoc.
+func New(opts ...Option) *SearchEngine {
 	s := &SearchEngine{
-		Index: make(map[string][]int), // Initialize the Index map.
+		Index:        make(map[string]*PostingList), // Initialize the Index map.
+		ShingleIndex: make(map[string]*PostingList), // Initialize the ShingleIndex map.
+		Analyzer:     NewEnglishAnalyzer(),          // Analyze English text unless configured otherwise.
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// NewSearchEngine creates a new SearchEngine instance and initializes it with the documents loaded from the specified path.
+// Options are applied before the documents are indexed.
+// It returns a pointer to the newly created SearchEngine.
+func NewSearchEngine(path string, opts ...Option) *SearchEngine {
+	s := New(opts...)
 	err := s.LoadDocuments(path) // Load documents from the specified path.
 	if err != nil {
 		panic(err) // Panic if an error occurs while loading documents.
@@ -38,253 +134,307 @@ func NewSearchEngine(path string) *SearchEngine {
 }
 
 // LoadDocuments loads and processes the documents from the specified path.
-// It opens the file, creates a gzip reader, and decodes the XML data into a temporary slice of documents.
-// Then, it converts the temporary documents to actual documents and assigns IDs to them.
+// It opens the corpus with OpenSource, which detects its compression (gzip, bzip2, zstd or none) and its format:
+// an abstract dump (<feed><doc>), whose leftover markup is cleaned with cleanWikitext, a MediaWiki page export
+// (<mediawiki><page>) such as pages-articles.xml.bz2, whose articles are converted to plain text, JSON lines, CSV,
+// or a directory of text and Markdown files. The internal links of wiki documents are recorded in their Links.
+// Documents are assigned IDs in the order of the corpus.
 // Parameters:
 //
-//	path: a string representing the path to the file containing the documents in gzip-compressed XML format.
+//	path: a string representing the path to the file or directory containing the documents.
 //
 // Return values:
 //
 //	error: an error if any occurred during the process, or nil if the operation was successful.
 func (s *SearchEngine) LoadDocuments(path string) error {
-	// Open the file
-	f, err := os.Open(path)
+	source, err := OpenSource(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer source.Close()
+	if err := s.LoadSource(source); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
 
-	// Create a gzip reader
-	gz, err := gzip.NewReader(f)
-	if err != nil {
-		return err
+// IndexDoc indexes the documents in the SearchEngine by tokenizing and adding them to the Index map,
+// to the ShingleIndex map when the analyzer emits shingles, and to the ExactIndex map when the SearchEngine keeps one.
+// Once every document is indexed, the posting lists of very frequent terms are converted to bitmaps.
+// Its progress is reported by Progress.
+func (s *SearchEngine) IndexDoc() {
+	s.progress.start(PhaseIndexing, nil, len(s.Documents))
+	indexes := s.indexes()
+	s.lengths, s.exactLengths = nil, nil
+	terms := 0
+	for i, doc := range s.Documents {
+		start := time.Now()
+		terms += s.indexDocument(indexes, doc)
+		elapsed := time.Since(start)
+		s.progress.update(func(p *Progress) {
+			p.Documents = i + 1
+			p.IndexTime += elapsed
+		})
 	}
-	defer gz.Close()
+	s.finishIndex(terms)
+	s.progress.finish()
+}
 
-	// Create an XML decoder
-	dec := xml.NewDecoder(gz)
+// indexSet groups the indexes a document is added to: those of the SearchEngine, or those of a segment being ingested.
+type indexSet struct {
+	index    map[string]*PostingList
+	shingles map[string]*PostingList
+	exact    map[string]*PostingList // nil when the SearchEngine keeps no ExactIndex.
+}
+
+// indexes returns the indexes of the SearchEngine.
+func (s *SearchEngine) indexes() indexSet {
+	return indexSet{index: s.Index, shingles: s.ShingleIndex, exact: s.ExactIndex}
+}
 
-	// Define a temporary struct for decoding
-	type tempDocument struct {
-		Title    string `xml:"title"`
-		URL      string `xml:"url"`
-		Abstract string `xml:"abstract"`
+// indexDocument adds the terms of the document to the indexes and returns the number of terms of its text.
+// Documents must be indexed in ID order, as the number of terms of their text is recorded for scoring.
+func (s *SearchEngine) indexDocument(indexes indexSet, doc Document) int {
+	words, shingles := s.analyzeWithShingles(doc.Text, indexMode)
+	addPostings(indexes.index, words, doc.ID)
+	addPostings(indexes.shingles, shingles, doc.ID)
+	s.lengths = append(s.lengths, len(words))
+	if indexes.exact != nil {
+		exact := s.analyzeExactTokens(doc.Text, indexMode)
+		addPostings(indexes.exact, exact, doc.ID)
+		s.exactLengths = append(s.exactLengths, len(exact))
 	}
+	return len(words)
+}
 
-	// Decode XML data into temporary slice of documents
-	dump := struct {
-		Documents []tempDocument `xml:"doc"`
-	}{}
-	if err := dec.Decode(&dump); err != nil {
-		return err
+// textLength returns the number of terms of the text of the document, in the ExactIndex when exact is set
+// and the SearchEngine keeps one.
+func (s *SearchEngine) textLength(docID int, exact bool) int {
+	if exact && s.ExactIndex != nil {
+		return s.exactLengths[docID]
 	}
+	return s.lengths[docID]
+}
 
-	// Convert temporary documents to actual documents
-	var documents []Document
-	for i, tempDoc := range dump.Documents {
-		document := Document{
-			ID:    i,
-			Title: tempDoc.Title,
-			URL:   tempDoc.URL,
-			Text:  tempDoc.Abstract,
-		}
-		documents = append(documents, document)
+// finishIndex completes the indexes once every document is added: it records the average length of the texts
+// from their total number of terms, converts the posting lists of very frequent terms to bitmaps and
+// outdates the cached results.
+func (s *SearchEngine) finishIndex(terms int) {
+	if len(s.Documents) > 0 {
+		s.averageLength = float64(terms) / float64(len(s.Documents))
 	}
+	for _, postings := range s.Index {
+		postings.compact(len(s.Documents))
+	}
+	for _, postings := range s.ExactIndex {
+		postings.compact(len(s.Documents))
+	}
+	for _, postings := range s.ShingleIndex {
+		postings.compact(len(s.Documents))
+	}
+	s.generation.Add(1) // Results cached for the previous index are outdated.
+}
 
-	// Assign IDs to documents
-	s.Documents = documents
+// IndexStats describes the size of the indexes of a SearchEngine.
+type IndexStats struct {
+	Documents int // Number of indexed documents.
+	Terms     int // Number of distinct terms in the Index.
+	Postings  int // Number of (term, document) pairs in the Index.
+	Positions int // Number of term occurrences recorded in the Index.
 
-	return nil
+	ExactTerms    int // Number of distinct terms in the ExactIndex.
+	ExactPostings int // Number of (term, document) pairs in the ExactIndex.
+	Shingles      int // Number of distinct shingles in the ShingleIndex.
+	ShingleCount  int // Number of (shingle, document) pairs in the ShingleIndex.
 }
 
-// IndexDoc indexes the documents in the SearchEngine by tokenizing and adding them to the Index map.
-func (s *SearchEngine) IndexDoc() {
-	for _, doc := range s.Documents {
-		for _, token := range analyze(doc.Text) {
-			ids := s.Index[token]
-			if ids != nil && ids[len(ids)-1] == doc.ID {
-				// Token already exists in Index.
-				continue
-			}
-			s.Index[token] = append(ids, doc.ID)
-		}
+// IndexStats walks the indexes and returns their size.
+func (s *SearchEngine) IndexStats() IndexStats {
+	stats := IndexStats{
+		Documents:  len(s.Documents),
+		Terms:      len(s.Index),
+		ExactTerms: len(s.ExactIndex),
+		Shingles:   len(s.ShingleIndex),
 	}
-}
-
-// Intersection returns the intersection of two slices.
-// It takes two integer slices a and b as input and returns a new slice containing the common elements between the two input slices.
-// Parameters:
-//
-//	a: an integer slice representing the first input slice.
-//	b: an integer slice representing the second input slice.
-//
-// Return values:
-//
-//	[]int: a new slice containing the common elements between the input slices a and b.
-func Intersection(a []int, b []int) []int {
-	maxLen := len(a)
-	if len(b) > maxLen {
-		maxLen = len(b)
+	for _, postings := range s.Index {
+		stats.Postings += postings.Len()
+		stats.Positions += len(postings.positions)
 	}
-	r := make([]int, 0, maxLen)
-	var i, j int
-	for i < len(a) && j < len(b) {
-		if a[i] < b[j] {
-			i++
-		} else if a[i] > b[j] {
-			j++
-		} else {
-			r = append(r, a[i])
-			i++
-			j++
-		}
+	for _, postings := range s.ExactIndex {
+		stats.ExactPostings += postings.Len()
 	}
-	return r
+	for _, postings := range s.ShingleIndex {
+		stats.ShingleCount += postings.Len()
+	}
+	return stats
 }
 
-// tokenize returns a slice of tokens by splitting the input text based on non-letter and non-number characters.
-// It takes a string representing the input text and returns a slice of strings representing the tokens obtained after splitting the text.
-// Parameters:
-//
-//	text: a string representing the input text to be tokenized.
-//
-// Return values:
-//
-//	[]string: a slice of strings representing the tokens obtained after splitting the input text.
-func tokenize(text string) []string {
-	return strings.FieldsFunc(text, func(r rune) bool {
-		// Split on any character that is not a letter or a number.
-		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
-	})
+// Generation returns the generation of the index, which changes every time documents are indexed.
+func (s *SearchEngine) Generation() uint64 {
+	return s.generation.Load()
 }
 
-// analyze returns a slice of tokens after processing the input text through tokenization, lowercase filtering, stop word filtering, and stemming.
-// It takes a string representing the input text and returns a slice of strings representing the processed tokens.
-// Parameters:
-//
-//	text: a string representing the input text to be analyzed.
-//
-// Return values:
-//
-//	[]string: a slice of strings representing the processed tokens obtained after tokenization, lowercase filtering, stop word filtering, and stemming.
-//
-// analyze processes the input text by tokenizing, converting to lowercase, removing stop words, and stemming
-func analyze(text string) []string {
-	tokens := tokenize(text)                // Tokenize the input text.
-	tokens = lowercaseFilter(tokens)        // Apply lowercase filtering to the tokens.
-	tokens = removeNonEnglishFilter(tokens) // Remove non-English characters, numbers, and symbols.
-	tokens = stopWordFilter(tokens)         // Apply stop word filtering to the tokens.
-	tokens = stemmerFilter(tokens)          // Apply stemming to the tokens.
-
-	return tokens // Return the processed tokens.
+// addPostings adds the document ID and the token position to the posting list of every token term in the index.
+func addPostings(index map[string]*PostingList, tokens []Token, docID int) {
+	for _, token := range tokens {
+		postings, ok := index[token.Term]
+		if !ok {
+			postings = &PostingList{}
+			index[token.Term] = postings
+		}
+		postings.add(docID, token.Position)
+	}
 }
 
-// lowercaseFilter applies lowercase filtering to the input tokens and returns a new slice of strings with all tokens converted to lowercase.
-// It takes a slice of strings representing the input tokens and returns a new slice of strings with all tokens converted to lowercase.
+// lowercaseFilter applies lowercase filtering to the input tokens and returns a new slice of tokens with all terms converted to lowercase.
+// It takes a slice of tokens representing the input tokens and returns a new slice of tokens with all terms converted to lowercase.
 // Parameters:
 //
-//	tokens: a slice of strings representing the input tokens to be converted to lowercase.
+//	tokens: a slice of tokens representing the input tokens to be converted to lowercase.
 //
 // Return values:
 //
-//	[]string: a new slice of strings containing the input tokens converted to lowercase.
-func lowercaseFilter(tokens []string) []string {
-	r := make([]string, len(tokens))
+//	[]Token: a new slice of tokens containing the input tokens converted to lowercase.
+func lowercaseFilter(tokens []Token) []Token {
+	r := make([]Token, len(tokens))
 	for i, token := range tokens {
-		r[i] = strings.ToLower(token)
+		token.Term = strings.ToLower(token.Term)
+		r[i] = token
 	}
 	return r
 }
 
-// stopWordFilter returns a slice of tokens with stop words removed.
-// It takes a slice of strings representing the input tokens and removes any stop words from the input.
+// stopWordFilter returns a token filter that flags the stop words of the given set.
 // Stop words are common words that are often filtered out from text data because they do not carry significant meaning or are too common to be useful for searching or indexing.
+// Flagged tokens stay in the stream, so the SearchEngine can decide whether to index them or to use them inside phrases;
+// when it drops them, they leave a gap in the positions of the remaining tokens.
 // Parameters:
-//   tokens: a slice of strings representing the input tokens from which stop words are to be removed.
+//
+//	stopWords: the set of stop words to flag.
+//
 // Return values:
-//   []string: a new slice of strings containing the input tokens with stop words removed.
-
-func stopWordFilter(tokens []string) []string {
-	stopWords := map[string]struct{}{
-		"a": {}, "about": {}, "above": {}, "after": {}, "again": {},
-		"against": {}, "all": {}, "am": {}, "an": {}, "and": {},
-		"any": {}, "are": {}, "aren't": {}, "as": {}, "at": {},
-		"be": {}, "because": {}, "been": {}, "before": {}, "being": {},
-		"below": {}, "between": {}, "both": {}, "but": {}, "by": {},
-		"can't": {}, "cannot": {}, "could": {}, "couldn't": {}, "did": {},
-		"didn't": {}, "do": {}, "does": {}, "doesn't": {}, "doing": {},
-		"don't": {}, "down": {}, "during": {}, "each": {}, "few": {},
-		"for": {}, "from": {}, "further": {}, "had": {}, "hadn't": {},
-		"has": {}, "hasn't": {}, "have": {}, "haven't": {}, "having": {},
-		"he": {}, "he'd": {}, "he'll": {}, "he's": {}, "her": {},
-		"here": {}, "here's": {}, "hers": {}, "herself": {}, "him": {},
-		"himself": {}, "his": {}, "how": {}, "how's": {}, "i": {},
-		"i'd": {}, "i'll": {}, "i'm": {}, "i've": {}, "if": {},
-		"in": {}, "into": {}, "is": {}, "isn't": {}, "it": {},
-		"it's": {}, "its": {}, "itself": {}, "let's": {}, "me": {},
-		"more": {}, "most": {}, "mustn't": {}, "my": {}, "myself": {},
-		"no": {}, "nor": {}, "not": {}, "of": {}, "off": {},
-		"on": {}, "once": {}, "only": {}, "or": {}, "other": {},
-		"ought": {}, "our": {}, "ours": {}, "ourselves": {}, "out": {},
-		"over": {}, "own": {}, "same": {}, "shan't": {}, "she": {},
-		"she'd": {}, "she'll": {}, "she's": {}, "should": {}, "shouldn't": {},
-		"so": {}, "some": {}, "such": {}, "than": {}, "that": {},
-		"that's": {}, "the": {}, "their": {}, "theirs": {}, "them": {},
-		"themselves": {}, "then": {}, "there": {}, "there's": {}, "these": {},
-		"they": {}, "they'd": {}, "they'll": {}, "they're": {}, "they've": {},
-		"this": {}, "those": {}, "through": {}, "to": {}, "too": {},
-		"under": {}, "until": {}, "up": {}, "very": {}, "was": {},
-		"wasn't": {}, "we": {}, "we'd": {}, "we'll": {}, "we're": {},
-		"we've": {}, "were": {}, "weren't": {}, "what": {}, "what's": {},
-		"when": {}, "when's": {}, "where": {}, "where's": {}, "which": {},
-		"while": {}, "who": {}, "who's": {}, "whom": {}, "why": {},
-		"why's": {}, "with": {}, "won't": {}, "would": {}, "wouldn't": {},
-		"you": {}, "you'd": {}, "you'll": {}, "you're": {}, "you've": {},
-		"your": {}, "yours": {}, "yourself": {}, "yourselves": {},
-	}
-
-	var filteredTokens []string
-	for _, token := range tokens {
-		// Check if the token is not a stop word
-		if _, ok := stopWords[token]; !ok {
-			filteredTokens = append(filteredTokens, token)
+//
+//	func([]Token) []Token: a filter returning its input tokens with the Stop flag set on stop words.
+func stopWordFilter(stopWords StopWordSet) func([]Token) []Token {
+	return func(tokens []Token) []Token {
+		r := make([]Token, len(tokens))
+		for i, token := range tokens {
+			// Check if the token is a stop word
+			_, token.Stop = stopWords[token.Term]
+			r[i] = token
 		}
+		return r
 	}
-	return filteredTokens
 }
 
-// stemmerFilter returns a slice of stemmed tokens after applying the Snowball stemming algorithm.
-// It takes a slice of strings representing the input tokens and returns a new slice of strings containing the stemmed tokens.
+// stemmerFilter returns a token filter that applies a Snowball stemming algorithm to every token.
+// It takes the Stem function of a Snowball language package and returns a filter producing a new slice of tokens containing the stemmed terms.
 // Snowball stemming algorithm is used to reduce words to their root form, which helps in improving search and indexing capabilities by treating different forms of the same word as equivalent.
 // Parameters:
 //
-//	tokens: a slice of strings representing the input tokens to be stemmed.
+//	stem: the Stem function of a Snowball language package, such as english.Stem.
 //
 // Return values:
 //
-//	[]string: a new slice of strings containing the stemmed tokens obtained after applying the Snowball stemming algorithm to the input tokens.
-func stemmerFilter(tokens []string) []string {
-	r := make([]string, len(tokens))
-	for i, token := range tokens {
-		r[i] = snowballeng.Stem(token, false) // Apply Snowball stemming algorithm to the token.
+//	func([]Token) []Token: a filter returning the stemmed tokens obtained after applying the Snowball stemming algorithm to its input tokens.
+func stemmerFilter(stem func(word string, stemStopWords bool) string) func([]Token) []Token {
+	return func(tokens []Token) []Token {
+		r := make([]Token, len(tokens))
+		for i, token := range tokens {
+			token.Term = stem(token.Term, false) // Apply Snowball stemming algorithm to the token.
+			r[i] = token
+		}
+		return r
 	}
-	return r
 }
 
+// removeNonEnglishChars strips every character that is not an English letter or a digit,
+// so numeric and alphanumeric tokens such as "1969" or "mp3" are kept intact.
+// Apostrophes and hyphens between two kept characters survive, so contractions ("don't") and
+// compounds ("b-52") stay intact, and so does a decimal point between two digits ("3.14").
 func removeNonEnglishChars(word string) string {
-	re := regexp.MustCompile("[^a-zA-Z]+")
-	return re.ReplaceAllString(word, "")
+	runes := []rune(word)
+	kept := func(i int, digitsOnly bool) bool {
+		if i < 0 || i >= len(runes) {
+			return false
+		}
+		r := runes[i]
+		return (r >= '0' && r <= '9') || (!digitsOnly && ((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')))
+	}
+	var b strings.Builder
+	for i, r := range runes {
+		switch {
+		case kept(i, false):
+			b.WriteRune(r)
+		case (r == '\'' || r == '-') && kept(i-1, false) && kept(i+1, false):
+			b.WriteRune(r)
+		case r == '.' && kept(i-1, true) && kept(i+1, true):
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
 }
 
 // removeNonEnglishFilter applies the removeNonEnglishChars function to a slice of tokens
-func removeNonEnglishFilter(tokens []string) []string {
-	cleanedTokens := []string{}
+func removeNonEnglishFilter(tokens []Token) []Token {
+	cleanedTokens := []Token{}
 	for _, token := range tokens {
-		cleanedToken := removeNonEnglishChars(token)
-		if cleanedToken != "" {
-			cleanedTokens = append(cleanedTokens, cleanedToken)
+		token.Term = removeNonEnglishChars(token.Term)
+		if token.Term != "" {
+			cleanedTokens = append(cleanedTokens, token)
 		}
 	}
 	return cleanedTokens
 }
+
+// numericSuffixes are the English ordinal and plural suffixes numberFilter drops after a number.
+var numericSuffixes = []string{"st", "nd", "rd", "th", "s"}
+
+// numberFilter normalizes numeric tokens so different spellings of a number share a term.
+// Leading zeros are removed ("007" becomes "7") and ordinal or plural suffixes are dropped
+// ("21st" becomes "21", "1960s" becomes "1960"). Other tokens, such as "mp3", are left untouched.
+func numberFilter(tokens []Token) []Token {
+	r := make([]Token, len(tokens))
+	for i, token := range tokens {
+		digits := strings.TrimLeftFunc(token.Term, unicode.IsDigit)
+		if digits != token.Term {
+			number := token.Term[:len(token.Term)-len(digits)]
+			for _, suffix := range numericSuffixes {
+				if digits == suffix {
+					token.Term = number
+					break
+				}
+			}
+			if digits == "" || token.Term == number {
+				token.Term = strings.TrimLeft(number, "0")
+				if token.Term == "" {
+					token.Term = "0"
+				}
+			}
+		}
+		r[i] = token
+	}
+	return r
+}
+
+// minimalEnglishStem is a light English stemmer that only reduces plurals to their singular form,
+// following the "S-stemmer" of Harman (1991): "ies" becomes "y", "es" and "s" are removed, while words
+// ending in "us" or "ss" are kept. It never conflates words such as "universal" and "university".
+func minimalEnglishStem(word string, _ bool) string {
+	n := len(word)
+	if n < 3 || word[n-1] != 's' {
+		return word
+	}
+	switch word[n-2] {
+	case 'u', 's':
+		return word
+	case 'e':
+		if n > 3 && word[n-3] == 'i' && word[n-4] != 'a' && word[n-4] != 'e' {
+			return word[:n-3] + "y" // "queries" becomes "query".
+		}
+		if c := word[n-3]; c == 'i' || c == 'a' || c == 'o' || c == 'e' {
+			return word // "aies", "aes", "oes" and "ees" are left alone.
+		}
+	}
+	return word[:n-1]
+}
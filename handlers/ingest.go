@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultSegmentSize is the number of documents of a segment when WithCheckpoints is given no size.
+const DefaultSegmentSize = 100000
+
+// WithCheckpoints makes Ingest commit the index to dir every segmentSize documents (DefaultSegmentSize when 0),
+// so an interrupted ingest resumes from the last committed segment instead of starting over.
+// The segments hold analyzed terms: they are refused when the corpus or the analyzer options change, and dir must
+// then be emptied.
+func WithCheckpoints(dir string, segmentSize int) Option {
+	return func(s *SearchEngine) {
+		if segmentSize <= 0 {
+			segmentSize = DefaultSegmentSize
+		}
+		s.CheckpointDir = dir
+		s.SegmentSize = segmentSize
+	}
+}
+
+// segment is a committed run of consecutive documents and the postings of their terms, as stored in the
+// checkpoint directory.
+type segment struct {
+	Corpus       string          // Identity of the corpus the documents were read from, as returned by corpusIdentity.
+	Options      string          // Fingerprint of the options the documents were indexed with, as returned by optionsFingerprint.
+	FirstID      int             // ID of the first document of the segment.
+	Next         *SourcePosition // Position of the source after the documents, or nil when the source cannot seek.
+	Documents    []Document
+	Terms        int   // Number of terms of the texts of the documents, for the average length of the texts.
+	Lengths      []int // Number of terms of the text of every document.
+	ExactLengths []int // Number of terms of the text of every document in the ExactIndex, when there is one.
+	Index        map[string]segmentPostings
+	Shingles     map[string]segmentPostings
+	Exact        map[string]segmentPostings // nil when the SearchEngine keeps no ExactIndex.
+}
+
+// segmentPostings is the stored form of a posting list: its document IDs and the positions of the term in each of them,
+// laid out as in a PostingList.
+type segmentPostings struct {
+	IDs       []int
+	Starts    []int // Index in Positions of the first position of the document of the same index in IDs.
+	Positions []int
+}
+
+// Ingest loads the documents of the corpus at path and indexes them as they are read, replacing the loaded
+// documents. It opens the corpus with OpenSource and gives the same index as LoadDocuments followed by IndexDoc.
+// With WithCheckpoints, the index is committed to the checkpoint directory every SegmentSize documents, and the
+// committed segments of a previous ingest of the same corpus are read back instead of being indexed again; the
+// corpus is then read from the position recorded in the last segment when its source can seek.
+// Its progress is reported by Progress.
+// Parameters:
+//
+//	path: a string representing the path to the file or directory containing the documents.
+//
+// Return values:
+//
+//	error: an error if the corpus cannot be read, or the checkpoint directory cannot be read or written.
+func (s *SearchEngine) Ingest(path string) error {
+	corpus, err := corpusIdentity(path)
+	if err != nil {
+		return err
+	}
+	source, err := OpenSource(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if err := s.IngestSource(source, corpus); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// corpusIdentity identifies the corpus at path by its absolute path, size and modification time, so segments
+// committed for another corpus, or for an older version of the same file, are not resumed.
+func corpusIdentity(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %d %d", abs, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// optionsFingerprint returns a digest of the options deciding the terms the SearchEngine indexes: its analyzers,
+// whether stop words are indexed and the synonyms injected at index time. Segments committed with other options
+// are not resumed.
+func (s *SearchEngine) optionsFingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "analyzer %s\nstop words indexed %v\n", describeAnalyzer(s.Analyzer), s.IndexStopWords)
+	if s.ExactIndex != nil {
+		fmt.Fprintf(h, "exact analyzer %s\n", describeAnalyzer(s.ExactAnalyzer))
+	}
+	if s.Synonyms != nil && s.SynonymExpansion == IndexTimeSynonyms {
+		s.Synonyms.writeRules(h)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// IngestSource reads and indexes every document of the source, as Ingest does for a corpus file.
+// Parameters:
+//
+//	source: the documents to ingest.
+//	corpus: the identity of the corpus, recorded in the committed segments; ingests of the same corpus
+//	        must use the same identity to be resumed.
+//
+// Return values:
+//
+//	error: the first error of the source other than io.EOF, or of the checkpoint directory.
+func (s *SearchEngine) IngestSource(source DocumentSource, corpus string) error {
+	s.Documents = nil
+	s.lengths, s.exactLengths = nil, nil
+	s.Index = make(map[string]*PostingList)
+	s.ShingleIndex = make(map[string]*PostingList)
+	if s.ExactIndex != nil {
+		s.ExactIndex = make(map[string]*PostingList)
+	}
+	terms := 0
+	options := s.optionsFingerprint()
+	var next *SourcePosition
+	if s.CheckpointDir != "" {
+		if err := os.MkdirAll(s.CheckpointDir, 0o755); err != nil {
+			return err
+		}
+		resumed, position, err := s.resume(corpus, options)
+		if err != nil {
+			return err
+		}
+		terms, next = resumed, position
+	}
+
+	s.progress.start(PhaseLoading, source, 0)
+	if err := skipCommitted(source, len(s.Documents), next); err != nil {
+		return err
+	}
+	s.progress.update(func(p *Progress) { p.Documents = len(s.Documents) })
+
+	// Documents are indexed straight into the SearchEngine, or into the segment to commit next.
+	indexes := s.indexes()
+	current := &segment{}
+	if s.CheckpointDir != "" {
+		current, indexes = s.newSegment(corpus, options)
+	}
+	for {
+		start := time.Now()
+		document, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		read := time.Since(start)
+		start = time.Now()
+		document.ID = len(s.Documents)
+		s.Documents = append(s.Documents, document)
+		n := s.indexDocument(indexes, document)
+		terms += n
+		indexed := time.Since(start)
+		s.progress.update(func(p *Progress) {
+			p.Documents = len(s.Documents)
+			p.ReadTime += read
+			p.IndexTime += indexed
+		})
+		if s.CheckpointDir == "" {
+			continue
+		}
+		current.Documents = append(current.Documents, document)
+		current.Terms += n
+		if len(current.Documents) == s.SegmentSize {
+			current.Next = sourcePosition(source)
+			if err := s.commit(current, indexes); err != nil {
+				return err
+			}
+			current, indexes = s.newSegment(corpus, options)
+		}
+	}
+	if s.CheckpointDir != "" && len(current.Documents) > 0 {
+		current.Next = sourcePosition(source)
+		if err := s.commit(current, indexes); err != nil {
+			return err
+		}
+	}
+	s.finishIndex(terms)
+	s.progress.finish()
+	return nil
+}
+
+// skipCommitted moves the source past the documents of the committed segments. A source that can seek restarts
+// at the position recorded in the last segment; other sources, such as compressed files that can only be read
+// from their start, read the committed documents again.
+func skipCommitted(source DocumentSource, documents int, next *SourcePosition) error {
+	if seekable, ok := source.(seekableSource); ok && next != nil {
+		return seekable.Seek(*next)
+	}
+	for range documents {
+		if _, err := source.Next(); err != nil {
+			if err == io.EOF {
+				err = errors.New("the corpus has fewer documents than the committed segments")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// sourcePosition returns the position of the source after the documents it returned, or nil when it cannot seek.
+func sourcePosition(source DocumentSource) *SourcePosition {
+	seekable, ok := source.(seekableSource)
+	if !ok {
+		return nil
+	}
+	position := seekable.Position()
+	return &position
+}
+
+// newSegment starts the segment following the indexed documents, and returns it with the indexes its documents
+// are added to.
+func (s *SearchEngine) newSegment(corpus string, options string) (*segment, indexSet) {
+	indexes := indexSet{index: make(map[string]*PostingList), shingles: make(map[string]*PostingList)}
+	if s.ExactIndex != nil {
+		indexes.exact = make(map[string]*PostingList)
+	}
+	return &segment{Corpus: corpus, Options: options, FirstID: len(s.Documents)}, indexes
+}
+
+// segmentPath returns the path of the n-th segment, counting from 0, in the checkpoint directory.
+func (s *SearchEngine) segmentPath(n int) string {
+	return filepath.Join(s.CheckpointDir, fmt.Sprintf("segment-%06d.gob", n))
+}
+
+// commit writes the segment and its indexes to the checkpoint directory, then merges the indexes into those of
+// the SearchEngine. The segment file is written under a temporary name and renamed once synced, so a crash never
+// leaves a partial segment behind.
+func (s *SearchEngine) commit(seg *segment, indexes indexSet) error {
+	seg.Index = storePostings(indexes.index)
+	seg.Shingles = storePostings(indexes.shingles)
+	seg.Exact = storePostings(indexes.exact)
+	seg.Lengths = s.lengths[seg.FirstID:]
+	if s.ExactIndex != nil {
+		seg.ExactLengths = s.exactLengths[seg.FirstID:]
+	}
+
+	var n int
+	s.progress.update(func(p *Progress) { n = p.Segments })
+	path := s.segmentPath(n)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(seg)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("cannot commit segment %d: %w", n, err)
+	}
+
+	s.mergeIndexes(indexes)
+	s.progress.update(func(p *Progress) { p.Segments = n + 1 })
+	return nil
+}
+
+// resume reads back the segments committed to the checkpoint directory, in order, and adds their documents and
+// postings to the SearchEngine. It stops at the first missing segment and returns the number of terms of the
+// texts of the restored documents and the position of the source after them, nil when unknown.
+func (s *SearchEngine) resume(corpus string, options string) (int, *SourcePosition, error) {
+	s.progress.start(PhaseResuming, nil, 0)
+	terms := 0
+	var next *SourcePosition
+	for n := 0; ; n++ {
+		f, err := os.Open(s.segmentPath(n))
+		if errors.Is(err, fs.ErrNotExist) {
+			return terms, next, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		var seg segment
+		err = gob.NewDecoder(f).Decode(&seg)
+		f.Close()
+		if err != nil {
+			return 0, nil, fmt.Errorf("cannot read segment %d: %w", n, err)
+		}
+		if seg.Corpus != corpus {
+			return 0, nil, fmt.Errorf("%s holds segments of another corpus (%s), remove it to start over", s.CheckpointDir, seg.Corpus)
+		}
+		if seg.Options != options {
+			return 0, nil, fmt.Errorf("%s holds segments indexed with other analyzer options, remove it to start over", s.CheckpointDir)
+		}
+		if seg.FirstID != len(s.Documents) {
+			return 0, nil, fmt.Errorf("segment %d starts at document %d instead of %d", n, seg.FirstID, len(s.Documents))
+		}
+		next = seg.Next
+		s.Documents = append(s.Documents, seg.Documents...)
+		s.lengths = append(s.lengths, seg.Lengths...)
+		if s.ExactIndex != nil {
+			s.exactLengths = append(s.exactLengths, seg.ExactLengths...)
+		}
+		terms += seg.Terms
+		indexes := indexSet{index: loadPostings(seg.Index), shingles: loadPostings(seg.Shingles)}
+		if s.ExactIndex != nil {
+			indexes.exact = loadPostings(seg.Exact)
+		}
+		s.mergeIndexes(indexes)
+		s.progress.update(func(p *Progress) {
+			p.Documents = len(s.Documents)
+			p.Resumed = len(s.Documents)
+			p.Segments = n + 1
+		})
+	}
+}
+
+// mergeIndexes appends the postings of a segment to the indexes of the SearchEngine.
+// The documents of the segment must follow every document already indexed.
+func (s *SearchEngine) mergeIndexes(indexes indexSet) {
+	mergeIndex(s.Index, indexes.index)
+	mergeIndex(s.ShingleIndex, indexes.shingles)
+	if s.ExactIndex != nil {
+		mergeIndex(s.ExactIndex, indexes.exact)
+	}
+}
+
+// mergeIndex appends the posting lists of src to those of the same terms in dst.
+func mergeIndex(dst map[string]*PostingList, src map[string]*PostingList) {
+	for term, postings := range src {
+		if existing, ok := dst[term]; ok {
+			existing.appendList(postings)
+		} else {
+			dst[term] = postings
+		}
+	}
+}
+
+// storePostings converts the posting lists of an index to their stored form.
+func storePostings(index map[string]*PostingList) map[string]segmentPostings {
+	if index == nil {
+		return nil
+	}
+	stored := make(map[string]segmentPostings, len(index))
+	for term, postings := range index {
+		stored[term] = segmentPostings{IDs: postings.IDs(), Starts: postings.starts, Positions: postings.positions}
+	}
+	return stored
+}
+
+// loadPostings converts stored posting lists back to an index.
+func loadPostings(stored map[string]segmentPostings) map[string]*PostingList {
+	index := make(map[string]*PostingList, len(stored))
+	for term, postings := range stored {
+		index[term] = &PostingList{ids: postings.IDs, starts: postings.Starts, positions: postings.Positions}
+	}
+	return index
+}
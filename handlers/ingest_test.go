@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testSegmentSize is small enough for the test corpora to span several segments, the last one partial.
+const testSegmentSize = 7
+
+// testCorpus is a corpus of every format OpenSource reads, and whether its source can seek.
+type testCorpus struct {
+	name     string
+	path     string
+	seekable bool
+}
+
+// testDocumentText returns the text of the i-th document of the test corpora.
+func testDocumentText(i int) string {
+	topics := []string{"rivers", "mountains", "cities", "forests", "deserts"}
+	return fmt.Sprintf("Document %d is about %s and %s, near the %s.", i, topics[i%5], topics[i%3], topics[(i+1)%5])
+}
+
+// writeTestCorpora writes 40 documents to a temporary directory in every format, and copies the multistream dump
+// next to an index named as OpenSource expects.
+func writeTestCorpora(t *testing.T) []testCorpus {
+	t.Helper()
+	dir := t.TempDir()
+	const count = 40
+	var jsonl, abstracts, pages bytes.Buffer
+	var table bytes.Buffer
+	rows := csv.NewWriter(&table)
+	rows.Write([]string{"title", "url", "text"})
+	abstracts.WriteString("<feed>\n")
+	pages.WriteString(`<mediawiki xmlns="http://www.mediawiki.org/xml/export-0.10/">` + "\n")
+	pages.WriteString("<siteinfo><base>https://example.org/wiki/Main_Page</base></siteinfo>\n")
+	jsonl.Write(utf8BOM) // Files saved by some editors start with a byte order mark.
+	files := filepath.Join(dir, "files")
+	if err := os.Mkdir(files, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i := range count {
+		title, text := fmt.Sprintf("Doc %d", i), testDocumentText(i)
+		line, _ := json.Marshal(map[string]string{"title": title, "url": "https://example.org/" + title, "text": text})
+		jsonl.Write(line)
+		if i%4 == 0 {
+			jsonl.WriteString("\r\n\n") // CRLF line endings and blank lines are part of the byte offsets.
+		} else {
+			jsonl.WriteString("\n")
+		}
+		if i%6 == 0 {
+			text += "\nA second line, quoted in CSV."
+		}
+		rows.Write([]string{title, "https://example.org/" + title, text})
+		fmt.Fprintf(&abstracts, "<doc><title>%s</title><url>https://example.org/%d</url><abstract>%s</abstract></doc>\n", title, i, text)
+		fmt.Fprintf(&pages, "<page><title>%s</title><ns>%d</ns><id>%d</id><revision><timestamp>2024-01-02T03:04:05Z</timestamp><text>%s</text></revision></page>\n",
+			title, i%9/8, i, text) // Every ninth page is a talk page, which is skipped.
+		if err := os.WriteFile(filepath.Join(files, fmt.Sprintf("doc-%02d.txt", i)), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows.Flush()
+	abstracts.WriteString("</feed>\n")
+	pages.WriteString("</mediawiki>\n")
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(jsonl.Bytes())
+	gz.Close()
+
+	dump, err := os.ReadFile(multistreamPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := os.ReadFile(multistreamIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]byte{
+		"corpus.jsonl":    jsonl.Bytes(),
+		"corpus.jsonl.gz": compressed.Bytes(),
+		"corpus.csv":      table.Bytes(),
+		"abstracts.xml":   abstracts.Bytes(),
+		"pages.xml":       pages.Bytes(),
+		"dump.xml.bz2":    dump,
+		// The index of a multistream dump is detected by its name; its content may be uncompressed.
+		"dump-index.txt.bz2": index,
+	}
+	for name, content := range contents {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return []testCorpus{
+		{"jsonl", filepath.Join(dir, "corpus.jsonl"), true},
+		{"gzip", filepath.Join(dir, "corpus.jsonl.gz"), false},
+		{"csv", filepath.Join(dir, "corpus.csv"), true},
+		{"abstracts", filepath.Join(dir, "abstracts.xml"), true},
+		{"pages", filepath.Join(dir, "pages.xml"), true},
+		{"directory", files, true},
+		{"multistream", filepath.Join(dir, "dump.xml.bz2"), true},
+	}
+}
+
+func TestOpenSourceRejectsUnknownXML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sitemap.xml")
+	if err := os.WriteFile(path, []byte("<urlset><url><loc>https://example.org/</loc></url></urlset>\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if source, err := OpenSource(path); err == nil || !strings.Contains(err.Error(), "<urlset>") {
+		t.Errorf("OpenSource(%s) = %v, %v, want an error naming <urlset>", path, source, err)
+	}
+}
+
+func TestSourcesSeekPastReadDocuments(t *testing.T) {
+	for _, corpus := range writeTestCorpora(t) {
+		t.Run(corpus.name, func(t *testing.T) {
+			source, err := OpenSource(corpus.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			all := readTitles(t, source)
+			source.Close()
+			for _, read := range []int{0, 1, 8, len(all) - 1, len(all)} {
+				source, err := OpenSource(corpus.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for range read {
+					if _, err := source.Next(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				seekable, ok := source.(seekableSource)
+				if ok != corpus.seekable {
+					t.Fatalf("source is seekable: %v, want %v", ok, corpus.seekable)
+				}
+				if !ok {
+					source.Close()
+					return
+				}
+				position := seekable.Position()
+				source.Close()
+
+				source, err = OpenSource(corpus.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := source.(seekableSource).Seek(position); err != nil {
+					t.Fatalf("Seek(%+v) after %d documents: %v", position, read, err)
+				}
+				if got := readTitles(t, source); !slices.Equal(got, all[read:]) {
+					t.Errorf("after seeking past %d documents, titles = %v, want %v", read, got, all[read:])
+				}
+				source.Close()
+			}
+		})
+	}
+}
+
+// compareEngines fails the test unless the two SearchEngines hold the same documents, postings and search results.
+func compareEngines(t *testing.T, got *SearchEngine, want *SearchEngine) {
+	t.Helper()
+	if !reflect.DeepEqual(got.Documents, want.Documents) {
+		t.Fatalf("got %d documents, want %d: %v", len(got.Documents), len(want.Documents), got.Documents)
+	}
+	if len(got.Index) != len(want.Index) {
+		t.Fatalf("got %d terms, want %d", len(got.Index), len(want.Index))
+	}
+	for term, postings := range want.Index {
+		ids := postings.IDs()
+		if !slices.Equal(got.Index[term].IDs(), ids) {
+			t.Fatalf("postings of %q = %v, want %v", term, got.Index[term].IDs(), ids)
+		}
+		for _, id := range ids {
+			if !slices.Equal(got.Index[term].Positions(id), postings.Positions(id)) {
+				t.Fatalf("positions of %q in %d = %v, want %v", term, id, got.Index[term].Positions(id), postings.Positions(id))
+			}
+		}
+	}
+	for _, query := range []string{"rivers", "mountains cities", "document 12"} {
+		gotResult, err := got.Search(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantResult, err := want.Search(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotResult.Hits, wantResult.Hits) {
+			t.Errorf("Search(%q) = %v, want %v", query, gotResult.Hits, wantResult.Hits)
+		}
+	}
+}
+
+func TestIngestResumesCommittedSegments(t *testing.T) {
+	for _, corpus := range writeTestCorpora(t) {
+		t.Run(corpus.name, func(t *testing.T) {
+			want := NewSearchEngine(corpus.path)
+			dir := t.TempDir()
+			s := New(WithCheckpoints(dir, testSegmentSize))
+			if err := s.Ingest(corpus.path); err != nil {
+				t.Fatal(err)
+			}
+			compareEngines(t, s, want)
+			segments := s.Progress().Segments
+			if segments < 3 {
+				t.Fatalf("committed %d segments, want at least 3", segments)
+			}
+
+			// Resume every segment, then resume after losing the last two, as when a build is interrupted.
+			for _, lost := range []int{0, 2} {
+				for n := segments - lost; n < segments; n++ {
+					if err := os.Remove(s.segmentPath(n)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				resumed := New(WithCheckpoints(dir, testSegmentSize))
+				if err := resumed.Ingest(corpus.path); err != nil {
+					t.Fatal(err)
+				}
+				progress := resumed.Progress()
+				if want := min((segments-lost)*testSegmentSize, len(want.Documents)); progress.Resumed != want {
+					t.Errorf("resumed %d documents, want %d", progress.Resumed, want)
+				}
+				if progress.Segments != segments {
+					t.Errorf("%d segments after resuming, want %d", progress.Segments, segments)
+				}
+				compareEngines(t, resumed, want)
+			}
+		})
+	}
+}
+
+func TestIngestRefusesSegmentsOfOtherOptions(t *testing.T) {
+	corpus := writeTestCorpora(t)[0]
+	dir := t.TempDir()
+	if err := New(WithCheckpoints(dir, testSegmentSize)).Ingest(corpus.path); err != nil {
+		t.Fatal(err)
+	}
+	unstemmed, err := NewAnalyzer(AnalyzerConfig{Stemmer: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trigrams, err := NewAnalyzer(AnalyzerConfig{NGramMin: 3, NGramMax: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	synonyms, err := readSynonyms(strings.NewReader("river, stream\n"), NewEnglishAnalyzer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, option := range map[string]Option{
+		"stemmer":     WithAnalyzer(unstemmed),
+		"n-grams":     WithAnalyzer(trigrams),
+		"stop words":  WithStopWordsIndexed(),
+		"synonyms":    WithSynonyms(synonyms, IndexTimeSynonyms),
+		"exact index": WithExactIndex(unstemmed),
+	} {
+		s := New(WithCheckpoints(dir, testSegmentSize), option)
+		if err := s.Ingest(corpus.path); err == nil || !strings.Contains(err.Error(), "analyzer options") {
+			t.Errorf("with other %s, Ingest() = %v, want the segments refused", name, err)
+		}
+	}
+	// Query-time synonyms do not change the index.
+	s := New(WithCheckpoints(dir, testSegmentSize), WithSynonyms(synonyms, QueryTimeSynonyms))
+	if err := s.Ingest(corpus.path); err != nil {
+		t.Errorf("with query-time synonyms, Ingest() = %v", err)
+	}
+}
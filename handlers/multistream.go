@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// multistreamIndexPath returns the path of the offset index Wikipedia publishes next to a multistream dump,
+// e.g. "enwiki-latest-pages-articles-multistream-index.txt.bz2" for "enwiki-latest-pages-articles-multistream.xml.bz2",
+// or "" when the path is not a bzip2 XML dump.
+func multistreamIndexPath(path string) string {
+	if !strings.HasSuffix(path, ".xml.bz2") {
+		return ""
+	}
+	return strings.TrimSuffix(path, ".xml.bz2") + "-index.txt.bz2"
+}
+
+// multistreamSource reads a multistream bzip2 MediaWiki export, whose pages are compressed in independent bzip2
+// streams of about 100 pages. The streams listed by the offset index are decompressed and parsed in parallel,
+// and their articles are returned in the order of the dump, so document IDs do not depend on scheduling.
+// The decompression starts with the first call to Next, from the first stream or from the one given to Seek.
+type multistreamSource struct {
+	file    *os.File
+	offsets []int64 // Offsets of the page streams, followed by the size of the dump.
+	base    string  // URL prefix of the articles of the wiki.
+	workers int
+	first   int  // Index of the first stream to read.
+	skip    int  // Articles of the first stream to skip.
+	started bool // Whether the decompression has started.
+
+	batches  chan chan streamBatch // Results of the streams, in the order of the dump.
+	current  []Document            // Articles of the current stream not returned yet.
+	offset   int64                 // Offset of the current stream.
+	returned int                   // Articles of the current stream returned so far.
+	done     chan struct{}         // Closed by Close to stop the producer.
+	stop     sync.Once             // Closes done once, however many times Close is called.
+	read     atomic.Int64          // Bytes of the streams returned so far.
+	size     int64                 // Size of the dump.
+}
+
+// streamBatch holds the articles of a bzip2 stream, or the error that prevented reading them.
+type streamBatch struct {
+	documents      []Document
+	offset, length int64 // Offset and compressed size of the stream.
+	err            error
+}
+
+// streamJob is a bzip2 stream to decompress and parse.
+type streamJob struct {
+	offset, length int64
+	result         chan streamBatch
+}
+
+// OpenMultistream opens a multistream bzip2 MediaWiki export along with its offset index, whose lines are
+// "offset:page ID:title", and decompresses its streams with the given number of workers (all cores when workers < 1).
+// Parameters:
+//
+//	path: the path to the multistream dump, e.g. enwiki-latest-pages-articles-multistream.xml.bz2.
+//	indexPath: the path to its offset index, compressed or not.
+//	workers: the number of streams decompressed at the same time.
+//
+// Return values:
+//
+//	DocumentSource: the articles of the dump, in order, to be closed by the caller.
+//	error: an error if a file cannot be opened, or the index or the header of the dump are malformed.
+func OpenMultistream(path string, indexPath string, workers int) (DocumentSource, error) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	offsets, err := readMultistreamIndex(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// The first stream holds the <mediawiki> header and the <siteinfo> of the wiki, before the first page.
+	if len(offsets) == 0 || offsets[0] == 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s: no page streams after the header", indexPath)
+	}
+	base, err := readMultistreamHeader(io.NewSectionReader(file, 0, offsets[0]))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	m := &multistreamSource{
+		file:    file,
+		offsets: append(offsets, info.Size()),
+		base:    base,
+		workers: workers,
+		batches: make(chan chan streamBatch, 2*workers),
+		offset:  offsets[0],
+		done:    make(chan struct{}),
+		size:    info.Size(),
+	}
+	m.read.Store(offsets[0])
+	return m, nil
+}
+
+// start launches the workers decompressing the streams and the producer queuing them, from the first stream to read.
+func (m *multistreamSource) start() {
+	m.started = true
+	jobs := make(chan streamJob)
+	for range m.workers {
+		go func() {
+			for job := range jobs {
+				documents, err := readStream(io.NewSectionReader(m.file, job.offset, job.length), m.base)
+				job.result <- streamBatch{documents: documents, offset: job.offset, length: job.length, err: err}
+			}
+		}()
+	}
+	// Queue the streams in order; the buffer of batches bounds the number of streams decompressed ahead.
+	go func() {
+		defer close(jobs)
+		defer close(m.batches)
+		for i := m.first; i+1 < len(m.offsets); i++ {
+			job := streamJob{offset: m.offsets[i], length: m.offsets[i+1] - m.offsets[i], result: make(chan streamBatch, 1)}
+			select {
+			case m.batches <- job.result:
+			case <-m.done:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
+// readMultistreamIndex returns the distinct stream offsets of a multistream index, in ascending order.
+func readMultistreamIndex(path string) ([]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, closeReader, err := decompress(bufio.NewReaderSize(f, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer closeReader()
+	var offsets []int64
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		field, _, _ := strings.Cut(scanner.Text(), ":")
+		if field == "" {
+			continue
+		}
+		offset, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid offset %q", path, line, field)
+		}
+		if len(offsets) == 0 || offsets[len(offsets)-1] != offset {
+			offsets = append(offsets, offset)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(offsets)
+	return slices.Compact(offsets), nil
+}
+
+// readMultistreamHeader decompresses the header stream of a multistream dump and returns the URL prefix of the articles.
+func readMultistreamHeader(r io.Reader) (string, error) {
+	dec := xml.NewDecoder(bzip2.NewReader(r))
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return "", nil // The header has no <siteinfo>: articles have no URL.
+		}
+		if err != nil {
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == "siteinfo" {
+			var siteinfo struct {
+				Base string `xml:"base"`
+			}
+			if err := dec.DecodeElement(&siteinfo, &start); err != nil {
+				return "", err
+			}
+			return articleBase(siteinfo.Base), nil
+		}
+	}
+}
+
+// readStream decompresses a bzip2 stream of pages and returns its articles.
+// The last stream also holds the closing </mediawiki> tag, which is dropped since it closes no element of the stream.
+func readStream(r io.Reader, base string) ([]Document, error) {
+	data, err := io.ReadAll(bzip2.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	if end := bytes.LastIndex(data, []byte("</mediawiki>")); end >= 0 {
+		data = data[:end]
+	}
+	var documents []Document
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "page" {
+			continue
+		}
+		var page wikiPage
+		if err := dec.DecodeElement(&page, &start); err != nil {
+			return nil, err
+		}
+		if document, ok := page.document(base); ok {
+			documents = append(documents, document)
+		}
+	}
+}
+
+// Next returns the next article, waiting for its stream to be decompressed.
+func (m *multistreamSource) Next() (Document, error) {
+	if !m.started {
+		m.start()
+	}
+	for len(m.current) == 0 {
+		result, ok := <-m.batches
+		if !ok {
+			return Document{}, io.EOF
+		}
+		batch := <-result
+		if batch.err != nil {
+			return Document{}, batch.err
+		}
+		m.current, m.offset, m.returned = batch.documents, batch.offset, 0
+		m.read.Add(batch.length)
+		if m.skip > 0 {
+			skipped := min(m.skip, len(m.current))
+			m.current, m.returned, m.skip = m.current[skipped:], skipped, 0
+		}
+	}
+	document := m.current[0]
+	m.current = m.current[1:]
+	m.returned++
+	return document, nil
+}
+
+// Position returns the offset of the stream of the last article returned and the number of its articles returned.
+func (m *multistreamSource) Position() SourcePosition {
+	return SourcePosition{Offset: m.offset, Skip: m.returned}
+}
+
+// Seek makes the decompression start at the stream at the offset of the position, skipping its first articles.
+func (m *multistreamSource) Seek(position SourcePosition) error {
+	if m.started {
+		return errors.New("multistream: seek after reading")
+	}
+	i, ok := slices.BinarySearch(m.offsets[:len(m.offsets)-1], position.Offset)
+	if !ok {
+		return fmt.Errorf("multistream: no stream starts at offset %d", position.Offset)
+	}
+	m.first, m.skip = i, position.Skip
+	m.offset, m.returned = position.Offset, 0
+	m.read.Store(position.Offset)
+	return nil
+}
+
+// BytesRead returns the compressed size of the streams returned so far and the size of the dump.
+func (m *multistreamSource) BytesRead() (int64, int64) {
+	return m.read.Load(), m.size
+}
+
+// Close stops the decompression and closes the dump. Closing the source again only returns the error of the file.
+func (m *multistreamSource) Close() error {
+	m.stop.Do(func() { close(m.done) })
+	return m.file.Close()
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+)
+
+// testdata/multistream.xml.bz2 holds 100 pages, "Page 0" to "Page 99", in 20 bzip2 streams of 5 pages listed by
+// testdata/multistream-index.txt. Earlier streams are larger, so parallel workers finish them last.
+// Page 7 is a talk page and page 12 a redirect, which are both skipped.
+const (
+	multistreamPath      = "testdata/multistream.xml.bz2"
+	multistreamIndex     = "testdata/multistream-index.txt"
+	multistreamPageCount = 100
+)
+
+// readTitles returns the titles of every document of the source, in order.
+func readTitles(t *testing.T, source DocumentSource) []string {
+	t.Helper()
+	var titles []string
+	for {
+		document, err := source.Next()
+		if err == io.EOF {
+			return titles
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		titles = append(titles, document.Title)
+	}
+}
+
+func TestMultistreamKeepsDumpOrder(t *testing.T) {
+	var want []string
+	for i := range multistreamPageCount {
+		if i != 7 && i != 12 {
+			want = append(want, fmt.Sprintf("Page %d", i))
+		}
+	}
+	for _, workers := range []int{1, 3, 8} {
+		source, err := OpenMultistream(multistreamPath, multistreamIndex, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readTitles(t, source)
+		source.Close()
+		if !slices.Equal(got, want) {
+			t.Errorf("with %d workers, titles = %v, want %v", workers, got, want)
+		}
+	}
+}
+
+func TestMultistreamMatchesSequentialRead(t *testing.T) {
+	source, err := OpenMultistream(multistreamPath, multistreamIndex, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	// The index is not named after the dump, so OpenSource decompresses it sequentially.
+	sequential, err := OpenSource(multistreamPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sequential.Close()
+	for {
+		want, err := sequential.Next()
+		if err == io.EOF {
+			if _, err := source.Next(); err != io.EOF {
+				t.Errorf("multistream source has more documents than the sequential one")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := source.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", want.Title, err)
+		}
+		if got.Title != want.Title || got.URL != want.URL || got.Text != want.Text || !slices.Equal(got.Links, want.Links) {
+			t.Fatalf("multistream document %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestMultistreamCloseStopsEarly(t *testing.T) {
+	source, err := OpenMultistream(multistreamPath, multistreamIndex, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Close(); err != nil {
+		t.Fatal(err)
+	}
+	source.Close() // Deferred closes may close the source again.
+}
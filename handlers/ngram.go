@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// shingleType is the Type of the word shingles emitted by shingleFilter.
+// Shingles are stored in the ShingleIndex rather than in the Index.
+const shingleType = "shingle"
+
+// gramType is the Type of the character n-grams emitted by ngramFilter.
+const gramType = "gram"
+
+// isCJK reports whether the word is written in a script without spaces between words: Han, Hiragana, Katakana or Hangul.
+func isCJK(word string) bool {
+	r, _ := utf8.DecodeRuneInString(word)
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) || classify(r) == classKatakana
+}
+
+// positionGap returns the number of positions left empty between two consecutive tokens, e.g. by removed stop words.
+func positionGap(previous Token, token Token) int {
+	if gap := token.Position - previous.Position - 1; gap > 0 {
+		return gap
+	}
+	return 0
+}
+
+// cjkRunsFilter merges the Han and Hiragana characters the tokenizer returns one per token back into
+// the runs they were written in, so ngramFilter can split them into overlapping grams.
+// Positions are renumbered so every run takes a single position.
+func cjkRunsFilter(tokens []Token) []Token {
+	var r []Token
+	position := 0
+	for i, token := range tokens {
+		if i > 0 {
+			previous := tokens[i-1]
+			if classify(firstRune(previous.Term)) == classIdeographic && classify(firstRune(token.Term)) == classIdeographic &&
+				previous.End == token.Start {
+				// Extend the current run.
+				run := &r[len(r)-1]
+				run.Term += token.Term
+				run.End = token.End
+				continue
+			}
+			position += 1 + positionGap(previous, token)
+		}
+		token.Position = position
+		r = append(r, token)
+	}
+	return r
+}
+
+// firstRune returns the first rune of s.
+func firstRune(s string) rune {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r
+}
+
+// ngramFilter returns a token filter that splits tokens into character n-grams of min to max characters.
+// Every character of a token takes its own position and the grams starting at it share that position,
+// so phrases of grams still line up. Tokens shorter than min are kept whole.
+// When cjkOnly is set, only tokens written in CJK scripts are split and other tokens pass through.
+func ngramFilter(min int, max int, cjkOnly bool) func([]Token) []Token {
+	return func(tokens []Token) []Token {
+		var r []Token
+		position := 0
+		for i, token := range tokens {
+			if i > 0 {
+				position += positionGap(tokens[i-1], token)
+			}
+			runes := []rune(token.Term)
+			if len(runes) < min || (cjkOnly && !isCJK(token.Term)) {
+				token.Position = position
+				r = append(r, token)
+				position++
+				continue
+			}
+			offset := token.Start
+			starts := len(runes) - min + 1
+			for k := 0; k < starts; k++ {
+				for n := min; n <= max && k+n <= len(runes); n++ {
+					gram := string(runes[k : k+n])
+					r = append(r, Token{
+						Term:     gram,
+						Position: position + k,
+						Start:    offset,
+						End:      offset + len(gram),
+						Stop:     token.Stop,
+						Type:     gramType,
+					})
+				}
+				offset += utf8.RuneLen(runes[k])
+			}
+			position += starts
+		}
+		return r
+	}
+}
+
+// shingleFilter returns a token filter that adds word shingles of 2 to max consecutive terms, such as "new york".
+// Shingles are joined with a space, take the position of their first word and have the Type "shingle".
+// Stop words and position gaps break shingles, so "king of france" yields no "king france" shingle.
+// Shingles are built from words only: character n-grams are neither shingled nor crossed.
+func shingleFilter(max int) func([]Token) []Token {
+	return func(tokens []Token) []Token {
+		r := append([]Token(nil), tokens...)
+		for i, first := range tokens {
+			if first.Stop || first.Type != "" {
+				continue
+			}
+			words := []string{first.Term}
+			last := first
+			for j := i + 1; j < len(tokens) && len(words) < max; j++ {
+				token := tokens[j]
+				if token.Position == last.Position {
+					continue // Skip tokens stacked on the same position, such as synonyms.
+				}
+				if token.Stop || token.Type != "" || token.Position != last.Position+1 {
+					break
+				}
+				words = append(words, token.Term)
+				last = token
+				r = append(r, Token{
+					Term:     strings.Join(words, " "),
+					Position: first.Position,
+					Start:    first.Start,
+					End:      last.End,
+					Type:     shingleType,
+				})
+			}
+		}
+		sort.SliceStable(r, func(i, j int) bool { return r[i].Position < r[j].Position })
+		return r
+	}
+}
+
+// splitShingles separates the word shingles of a token stream from the other tokens.
+func splitShingles(tokens []Token) (words []Token, shingles []Token) {
+	for _, token := range tokens {
+		if token.Type == shingleType {
+			shingles = append(shingles, token)
+		} else {
+			words = append(words, token)
+		}
+	}
+	return words, shingles
+}
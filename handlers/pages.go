@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// articleNamespace is the namespace of the articles of a wiki; talk, user, template and other pages live in other namespaces.
+const articleNamespace = 0
+
+// wikiPage is a <page> element of a MediaWiki export, holding its latest revision.
+type wikiPage struct {
+	Title     string `xml:"title"`
+	Namespace int    `xml:"ns"`
+	ID        int    `xml:"id"`
+	Redirect  *struct {
+		Title string `xml:"title,attr"`
+	} `xml:"redirect"`
+	Revision struct {
+		Timestamp string `xml:"timestamp"`
+		Text      string `xml:"text"`
+	} `xml:"revision"`
+}
+
+// pageSource streams the <page> elements of a MediaWiki export, such as pages-articles.xml.bz2.
+// Pages outside the article namespace and redirects are skipped. The wikitext of the articles is converted to
+// plain text with cleanWikitext, which also returns their internal links, and the URL of an article is built
+// from the base URL of the wiki in <siteinfo>.
+type pageSource struct {
+	dec     *xml.Decoder      // Decoder positioned after the <mediawiki> start element.
+	pending *xml.StartElement // Start element read after <siteinfo> by newPageSource, decoded by the next call to Next.
+	start   int64             // Offset in the export of the input of dec.
+	end     int64             // Offset in the export of the end of the last article returned.
+	base    string            // URL prefix of the articles of the wiki.
+	close   func() error
+}
+
+// newPageSource returns the source of the pages decoded by dec, positioned after the <mediawiki> start element.
+// The <siteinfo> preceding the pages is read first, so the URLs of the articles are known even when the source
+// seeks past the start of the export.
+func newPageSource(dec *xml.Decoder, closeAll func() error) (*pageSource, error) {
+	p := &pageSource{dec: dec, end: dec.InputOffset(), close: closeAll}
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "siteinfo" {
+			start = start.Copy()
+			p.pending = &start
+			return p, nil
+		}
+		var siteinfo struct {
+			Base string `xml:"base"`
+		}
+		if err := dec.DecodeElement(&siteinfo, &start); err != nil {
+			return nil, err
+		}
+		p.base = articleBase(siteinfo.Base)
+		p.end = dec.InputOffset()
+		return p, nil
+	}
+}
+
+// Next decodes the pages up to the next article.
+func (p *pageSource) Next() (Document, error) {
+	for {
+		start, err := p.nextStart()
+		if err != nil {
+			return Document{}, err
+		}
+		if start.Name.Local != "page" {
+			continue
+		}
+		var page wikiPage
+		if err := p.dec.DecodeElement(&page, &start); err != nil {
+			return Document{}, err
+		}
+		if document, ok := page.document(p.base); ok {
+			p.end = p.start + p.dec.InputOffset()
+			return document, nil
+		}
+	}
+}
+
+// nextStart returns the next start element of the export.
+func (p *pageSource) nextStart() (xml.StartElement, error) {
+	if p.pending != nil {
+		start := *p.pending
+		p.pending = nil
+		return start, nil
+	}
+	for {
+		token, err := p.dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
+
+// document converts an article to a Document, with its wikitext cleaned and the URL built from the base URL of the wiki.
+// It returns false for pages outside the article namespace and redirects, which are not indexed.
+func (page *wikiPage) document(base string) (Document, bool) {
+	if page.Namespace != articleNamespace || page.Redirect != nil {
+		return Document{}, false
+	}
+	timestamp, _ := time.Parse(time.RFC3339, page.Revision.Timestamp)
+	text, links := cleanWikitext(page.Revision.Text)
+	return Document{
+		Title:     page.Title,
+		URL:       articleURL(base, page.Title),
+		Text:      text,
+		Links:     links,
+		PageID:    page.ID,
+		Namespace: page.Namespace,
+		Timestamp: timestamp,
+	}, true
+}
+
+// offset returns the byte offset of the end of the last article returned.
+func (p *pageSource) offset() int64 {
+	return p.end
+}
+
+// reset goes on decoding the pages from r, which starts at the given byte offset of the export.
+func (p *pageSource) reset(r io.Reader, offset int64) {
+	p.dec, p.start = resumeXML("mediawiki", r, offset)
+	p.pending, p.end = nil, offset
+}
+
+// Close closes the export.
+func (p *pageSource) Close() error {
+	return p.close()
+}
+
+// articleBase returns the URL prefix of the articles of a wiki from the URL of its main page,
+// e.g. "https://en.wikipedia.org/wiki/" for "https://en.wikipedia.org/wiki/Main_Page".
+func articleBase(mainPage string) string {
+	if i := strings.LastIndex(mainPage, "/"); i >= 0 {
+		return mainPage[:i+1]
+	}
+	return ""
+}
+
+// articleURL returns the URL of the article with the given title, or "" when the base URL of the wiki is unknown.
+func articleURL(base string, title string) string {
+	if base == "" {
+		return ""
+	}
+	return base + url.PathEscape(strings.ReplaceAll(title, " ", "_"))
+}
@@ -1,51 +1,156 @@
 package handlers
 
-// SearchPhrase performs a phrase search and returns matching document IDs.
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SearchPhrase performs a phrase search and returns the matching documents.
 // It takes a query string as input, removes any double quotes from the query,
-// tokenizes the query into individual words, and then searches for the presence
-// of the tokens in the indexed documents. It returns a slice of document IDs
-// that match the entire phrase query.
-func (s *SearchEngine) SearchPhrase(query string) []int {
-	queryTokens := analyze(query) // Use the analyze function to process the query
+// tokenizes the query into individual words, and then looks up the positions
+// of the tokens in the Index. The documents that match the entire phrase query
+// are ranked by the relevance score (TF-IDF or BM25, see Scoring) of the phrase terms. With query-time synonyms, the phrase is
+// expanded to every synonym variant and documents matching any of them are returned.
+// A sloppy phrase such as "new york"~2 also matches when the words are up to 2 moves
+// away from the phrase, e.g. separated by other words or swapped.
+// It stops and returns the error of the context when the context is canceled or its deadline passes.
+// With a QueryCache, the results of phrases analyzing to the same terms are reused.
+func (s *SearchEngine) SearchPhrase(ctx context.Context, query string) (*SearchResult, error) {
+	return s.cached(s.phraseCacheKey(query), func() (*SearchResult, error) {
+		return s.searchPhrase(ctx, query)
+	})
+}
 
+// searchPhrase runs a phrase query without looking it up in the cache.
+func (s *SearchEngine) searchPhrase(ctx context.Context, query string) (*SearchResult, error) {
+	start := time.Now()
+	text, slop := parsePhrase(query)
+	queryTokens := s.analyzeTokens(text, phraseMode) // Use the analyze function to process the query
+	phrase := &regularQuery{}
+	for _, token := range queryTokens {
+		phrase.queryTerms = append(phrase.queryTerms, queryTerm{Term: token.Term})
+	}
+	matches, err := s.phraseMatches(ctx, queryTokens, slop)
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]Hit, 0, len(matches))
+	for i, docID := range matches {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, err
+		}
+		hits = append(hits, s.newHit(phrase, docID))
+	}
+	return newSearchResult(hits, start), nil
+}
+
+// phraseMatches returns the IDs of the documents matching the analyzed phrase tokens, or any of their
+// synonym variants with query-time synonyms.
+func (s *SearchEngine) phraseMatches(ctx context.Context, queryTokens []Token, slop int) ([]int, error) {
 	if len(queryTokens) == 0 {
-		return nil // Return nil if the query contains no tokens
+		return nil, nil // Return nil if the query contains no tokens
 	}
 
-	// Get the list of documents containing the first token
-	firstToken := queryTokens[0]
-	resultSet, ok := s.Index[firstToken]
+	variants := [][]Token{queryTokens}
+	if s.Synonyms != nil && s.SynonymExpansion == QueryTimeSynonyms {
+		variants = s.Synonyms.Variants(queryTokens)
+	}
+	if len(variants) == 1 {
+		return s.matchPhrase(ctx, variants[0], slop)
+	}
+	matches := &PostingList{}
+	for _, variant := range variants {
+		variantMatches, err := s.matchPhrase(ctx, variant, slop)
+		if err != nil {
+			return nil, err
+		}
+		matches = Union(matches, NewPostingList(variantMatches))
+	}
+	return matches.IDs(), nil
+}
+
+// parsePhrase splits a phrase query into its text and its slop, the number following a '~'
+// after the closing quote. The slop is 0 for exact phrases.
+func parsePhrase(query string) (string, int) {
+	query = strings.TrimSpace(query)
+	quote := strings.LastIndex(query, "\"")
+	if quote < 0 {
+		return query, 0
+	}
+	suffix, ok := strings.CutPrefix(query[quote+1:], "~")
 	if !ok {
-		return nil // Return nil if no document IDs are associated with the first token
+		return query, 0
+	}
+	slop, err := strconv.Atoi(suffix)
+	if err != nil || slop < 0 {
+		return query, 0
 	}
+	return query[:quote+1], slop
+}
 
-	// Iterate through the result set to check for the presence of the phrase in the documents
+// matchPhrase returns the IDs of the documents containing the analyzed phrase tokens, within slop moves of the phrase.
+// The postings of all the tokens are intersected starting from the rarest, so a phrase starting with a frequent
+// term costs no more than one ending with it, and only the documents containing every token are checked.
+// The positions of every candidate are then aligned on the phrase: a token expected k positions after the first one
+// is moved k positions back. Query positions keep the gaps left by stop words, so "king of france" requires a word
+// between "king" and "france" even when stop words are not indexed.
+// Parameters:
+//
+//	ctx: the context of the query.
+//	tokens: the analyzed phrase tokens, with their positions in the phrase.
+//	slop: the number of moves allowed, 0 for an exact phrase.
+//
+// Return values:
+//
+//	[]int: the IDs of the matching documents, in ascending order.
+//	error: the error of the context if it is canceled while the candidates are checked.
+func (s *SearchEngine) matchPhrase(ctx context.Context, tokens []Token, slop int) ([]int, error) {
+	lists := make([]*PostingList, len(tokens))
+	for i, token := range tokens {
+		postings, ok := s.Index[token.Term]
+		if !ok {
+			return nil, nil // A token of the phrase doesn't exist in Index.
+		}
+		lists[i] = postings
+	}
 	finalResults := []int{}
-	for _, docID := range resultSet {
-		doc := s.Documents[docID]
-		docTokens := analyze(doc.Text) // Use the analyze function to process the document text
-
-		if containsExactPhrase(docTokens, queryTokens) {
+	aligned := make([][]int, len(tokens))
+	for n, docID := range intersectAll(lists).IDs() {
+		if err := checkContext(ctx, n); err != nil {
+			return nil, err
+		}
+		for i, token := range tokens {
+			aligned[i] = shiftPositions(lists[i].Positions(docID), tokens[0].Position-token.Position)
+		}
+		if matchesAligned(aligned, slop) {
 			finalResults = append(finalResults, docID)
 		}
 	}
-
-	return finalResults // Return the resulting document IDs that match the entire phrase query
+	return finalResults, nil // Return the resulting document IDs that match the entire phrase query
 }
 
-// containsPhrase checks if the document tokens contain the query tokens in the same order
-func containsExactPhrase(docTokens, queryTokens []string) bool {
-	for i := 0; i <= len(docTokens)-len(queryTokens); i++ {
-		match := true
-		for j := 0; j < len(queryTokens); j++ {
-			if docTokens[i+j] != queryTokens[j] {
-				match = false
-				break
-			}
+// matchesAligned reports whether the aligned positions of the phrase tokens hold a match within slop moves.
+// An exact phrase needs a position shared by every token, found by intersecting the positions from the shortest list.
+// A sloppy phrase matches when the smallest window holding one aligned position of every token is at most slop wide.
+func matchesAligned(aligned [][]int, slop int) bool {
+	if slop > 0 {
+		span := minSpan(aligned)
+		return span >= 0 && span <= slop
+	}
+	shortest := aligned[0]
+	for _, positions := range aligned[1:] {
+		if len(positions) < len(shortest) {
+			shortest = positions
 		}
-		if match {
-			return true
+	}
+	common := shortest
+	for _, positions := range aligned {
+		if len(common) == 0 {
+			break
 		}
+		common = intersectSorted(common, positions)
 	}
-	return false
+	return len(common) > 0
 }
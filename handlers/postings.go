@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"slices"
+	"sort"
+)
+
+// gallopingRatio is the size ratio between two posting lists above which intersectSorted
+// switches from a linear merge to galloping (exponential) search over the longer list.
+// Below it, the merge wins on cache-friendly sequential reads (see BenchmarkIntersectSkewed).
+const gallopingRatio = 32
+
+// denseRatio decides when a posting list is stored as a bitmap: a term whose documents make up
+// at least 1/denseRatio of the collection is considered dense.
+const denseRatio = 32
+
+// PostingList is the list of documents a term appears in.
+// Sparse lists are kept as sorted slices of document IDs; dense lists, such as those of very
+// frequent terms, are converted to Roaring-style bitmaps so boolean operations stay cheap.
+// Posting lists of an index also record the positions of the term in every document, for phrase
+// and proximity queries. Lists returned by the set operations only carry document IDs.
+type PostingList struct {
+	ids    []int   // Sorted document IDs, used while the list is sparse.
+	bitmap *Bitmap // Bitmap of document IDs, used once the list is dense.
+
+	// Positions are kept apart from the representation of the IDs, in the order of the documents: the sorted
+	// token positions of the term in the i-th document of the list are positions[starts[i]:starts[i+1]],
+	// the last document running to the end of positions.
+	starts    []int
+	positions []int
+}
+
+// NewPostingList returns a sparse PostingList holding the given sorted document IDs.
+func NewPostingList(ids []int) *PostingList {
+	return &PostingList{ids: ids}
+}
+
+// Len returns the number of documents in the posting list.
+func (p *PostingList) Len() int {
+	if p == nil {
+		return 0
+	}
+	if p.bitmap != nil {
+		return p.bitmap.Cardinality()
+	}
+	return len(p.ids)
+}
+
+// IDs returns the document IDs of the posting list as a sorted slice.
+func (p *PostingList) IDs() []int {
+	if p == nil {
+		return nil
+	}
+	if p.bitmap != nil {
+		return p.bitmap.ToSlice()
+	}
+	return p.ids
+}
+
+// Contains reports whether the document ID is in the posting list.
+func (p *PostingList) Contains(id int) bool {
+	if p.bitmap != nil {
+		return p.bitmap.Contains(id)
+	}
+	i := sort.SearchInts(p.ids, id)
+	return i < len(p.ids) && p.ids[i] == id
+}
+
+// Positions returns the sorted token positions of the term in the document,
+// or nil if the document is not in the list or the list carries no positions.
+func (p *PostingList) Positions(id int) []int {
+	if p == nil || len(p.starts) == 0 {
+		return nil
+	}
+	i, ok := p.rank(id)
+	if !ok {
+		return nil
+	}
+	end := len(p.positions)
+	if i+1 < len(p.starts) {
+		end = p.starts[i+1]
+	}
+	return p.positions[p.starts[i]:end:end]
+}
+
+// rank returns the index of the document ID in the posting list, and whether the list holds it.
+func (p *PostingList) rank(id int) (int, bool) {
+	if p.bitmap != nil {
+		if !p.bitmap.Contains(id) {
+			return 0, false
+		}
+		return p.bitmap.Rank(id), true
+	}
+	i := sort.SearchInts(p.ids, id)
+	return i, i < len(p.ids) && p.ids[i] == id
+}
+
+// IsBitmap reports whether the posting list is stored as a bitmap.
+func (p *PostingList) IsBitmap() bool {
+	return p.bitmap != nil
+}
+
+// add appends a document ID to the posting list and records the position of the term in the document.
+// IDs must be added in ascending order; adding the last ID again only records the position.
+func (p *PostingList) add(id int, position int) {
+	var last bool
+	if p.bitmap != nil {
+		last = p.bitmap.Contains(id)
+	} else {
+		last = len(p.ids) > 0 && p.ids[len(p.ids)-1] == id
+	}
+	if !last {
+		if p.bitmap != nil {
+			p.bitmap.Add(id)
+		} else {
+			p.ids = append(p.ids, id)
+		}
+		p.starts = append(p.starts, len(p.positions))
+		p.positions = append(p.positions, position)
+		return
+	}
+	// The positions of the last document end the list.
+	start := p.starts[len(p.starts)-1]
+	i := sort.SearchInts(p.positions[start:], position)
+	if start+i < len(p.positions) && p.positions[start+i] == position {
+		return
+	}
+	// Filters such as synonyms may emit tokens out of order.
+	p.positions = slices.Insert(p.positions, start+i, position)
+}
+
+// appendList appends the documents of src and their positions to the posting list.
+// The IDs of src must all be greater than the IDs of the posting list, as when merging the segments of an ingest.
+func (p *PostingList) appendList(src *PostingList) {
+	offset := len(p.positions)
+	for _, start := range src.starts {
+		p.starts = append(p.starts, offset+start)
+	}
+	p.positions = append(p.positions, src.positions...)
+	if p.bitmap != nil {
+		for _, id := range src.IDs() {
+			p.bitmap.Add(id)
+		}
+	} else {
+		p.ids = append(p.ids, src.IDs()...)
+	}
+}
+
+// compact switches the posting list to the representation that suits its density
+// within a collection of docCount documents.
+func (p *PostingList) compact(docCount int) {
+	dense := p.Len()*denseRatio >= docCount
+	if dense && p.bitmap == nil {
+		p.bitmap, p.ids = BitmapOf(p.ids), nil
+	} else if !dense && p.bitmap != nil {
+		p.ids, p.bitmap = p.bitmap.ToSlice(), nil
+	}
+}
+
+// asBitmap returns the posting list as a bitmap, converting a sparse list on the fly.
+func (p *PostingList) asBitmap() *Bitmap {
+	if p.bitmap != nil {
+		return p.bitmap
+	}
+	return BitmapOf(p.ids)
+}
+
+// Intersection returns the documents present in both posting lists (boolean AND).
+// It picks the algorithm for each pair of representations: bitmaps are ANDed container by container,
+// a sparse list is probed against a bitmap, and two sparse lists are merged or galloped.
+// Parameters:
+//
+//	a: the first posting list.
+//	b: the second posting list.
+//
+// Return values:
+//
+//	*PostingList: a new posting list containing the documents common to a and b.
+func Intersection(a *PostingList, b *PostingList) *PostingList {
+	switch {
+	case a.bitmap != nil && b.bitmap != nil:
+		return &PostingList{bitmap: a.bitmap.And(b.bitmap)}
+	case a.bitmap != nil:
+		return &PostingList{ids: filterIDs(b.ids, a.bitmap, true)}
+	case b.bitmap != nil:
+		return &PostingList{ids: filterIDs(a.ids, b.bitmap, true)}
+	}
+	return &PostingList{ids: intersectSorted(a.ids, b.ids)}
+}
+
+// Union returns the documents present in either posting list (boolean OR).
+// Parameters:
+//
+//	a: the first posting list.
+//	b: the second posting list.
+//
+// Return values:
+//
+//	*PostingList: a new posting list containing the documents of a and b.
+func Union(a *PostingList, b *PostingList) *PostingList {
+	if a.bitmap == nil && b.bitmap == nil {
+		return &PostingList{ids: unionSorted(a.ids, b.ids)}
+	}
+	return &PostingList{bitmap: a.asBitmap().Or(b.asBitmap())}
+}
+
+// unionAll returns the documents present in any of the posting lists, computing the union of all the lists at once
+// rather than pair by pair, which would copy the growing result for every list. Sparse lists are merged in a
+// balanced tree of pairwise merges, so every ID is copied O(log k) times for k lists; as soon as one list is a
+// bitmap, every list is ORed in place into a single bitmap. It returns an empty list if lists is empty.
+func unionAll(lists []*PostingList) *PostingList {
+	bitmaps := false
+	for _, list := range lists {
+		bitmaps = bitmaps || list.bitmap != nil
+	}
+	if !bitmaps {
+		return &PostingList{ids: mergeAll(lists)}
+	}
+	r := &Bitmap{}
+	for _, list := range lists {
+		if list.bitmap != nil {
+			r.orWith(list.bitmap)
+			continue
+		}
+		for _, id := range list.ids {
+			r.Add(id)
+		}
+	}
+	for _, c := range r.containers {
+		c.shrink()
+	}
+	return &PostingList{bitmap: r}
+}
+
+// mergeAll merges the IDs of sparse posting lists by merging their halves recursively.
+func mergeAll(lists []*PostingList) []int {
+	switch len(lists) {
+	case 0:
+		return []int{}
+	case 1:
+		return lists[0].ids
+	}
+	half := len(lists) / 2
+	return unionSorted(mergeAll(lists[:half]), mergeAll(lists[half:]))
+}
+
+// Difference returns the documents of a that are not in b (boolean AND NOT).
+// Parameters:
+//
+//	a: the posting list to subtract from.
+//	b: the posting list of documents to exclude.
+//
+// Return values:
+//
+//	*PostingList: a new posting list containing the documents of a that are not in b.
+func Difference(a *PostingList, b *PostingList) *PostingList {
+	switch {
+	case a.bitmap != nil:
+		return &PostingList{bitmap: a.bitmap.AndNot(b.asBitmap())}
+	case b.bitmap != nil:
+		return &PostingList{ids: filterIDs(a.ids, b.bitmap, false)}
+	}
+	return &PostingList{ids: differenceSorted(a.ids, b.ids)}
+}
+
+// intersectAll intersects the posting lists starting from the rarest one, so the
+// intermediate result shrinks as early as possible. It returns an empty list if lists is empty.
+func intersectAll(lists []*PostingList) *PostingList {
+	if len(lists) == 0 {
+		return &PostingList{}
+	}
+	byRarity := make([]*PostingList, len(lists))
+	copy(byRarity, lists)
+	sort.SliceStable(byRarity, func(i, j int) bool {
+		return byRarity[i].Len() < byRarity[j].Len()
+	})
+	result := byRarity[0]
+	for _, list := range byRarity[1:] {
+		if result.Len() == 0 {
+			break
+		}
+		result = Intersection(result, list)
+	}
+	return result
+}
+
+// filterIDs returns the IDs whose membership in the bitmap equals keep.
+func filterIDs(ids []int, b *Bitmap, keep bool) []int {
+	r := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if b.Contains(id) == keep {
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+// intersectSorted returns the common elements of two sorted slices.
+// When one slice is much shorter than the other, the shorter one drives the walk and the longer one is probed with galloping search,
+// so a rare term ANDed with a very common one costs O(m log n) instead of O(m + n).
+func intersectSorted(a []int, b []int) []int {
+	if len(a) > len(b) {
+		a, b = b, a // Make a the shorter slice.
+	}
+	if len(a) == 0 {
+		return []int{}
+	}
+	if len(b)/len(a) >= gallopingRatio {
+		return gallopingIntersection(a, b)
+	}
+	return mergeIntersection(a, b)
+}
+
+// mergeIntersection intersects two sorted slices with a linear two-pointer merge.
+// It is the fastest strategy when both slices have a similar length.
+func mergeIntersection(a []int, b []int) []int {
+	r := make([]int, 0, min(len(a), len(b)))
+	var i, j int
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			i++
+		} else if a[i] > b[j] {
+			j++
+		} else {
+			r = append(r, a[i])
+			i++
+			j++
+		}
+	}
+	return r
+}
+
+// gallopingIntersection intersects a short sorted slice with a much longer one.
+// For every element of small it gallops forward in large from the previous match, so
+// large is never scanned linearly.
+func gallopingIntersection(small []int, large []int) []int {
+	r := make([]int, 0, len(small))
+	lo := 0
+	for _, v := range small {
+		lo = gallop(large, lo, v)
+		if lo == len(large) {
+			break // Every remaining element of large is smaller than v.
+		}
+		if large[lo] == v {
+			r = append(r, v)
+			lo++
+		}
+	}
+	return r
+}
+
+// gallop returns the smallest index i >= lo such that s[i] >= target, or len(s) if there is none.
+// It doubles its step until it overshoots target and then binary searches the last step.
+func gallop(s []int, lo int, target int) int {
+	hi, step := lo, 1
+	for hi < len(s) && s[hi] < target {
+		lo = hi + 1
+		hi += step
+		step *= 2
+	}
+	if hi > len(s) {
+		hi = len(s)
+	}
+	return lo + sort.SearchInts(s[lo:hi], target)
+}
+
+// unionSorted merges two sorted slices into a sorted slice without duplicates.
+func unionSorted(a []int, b []int) []int {
+	r := make([]int, 0, len(a)+len(b))
+	var i, j int
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			r = append(r, a[i])
+			i++
+		case i == len(a) || a[i] > b[j]:
+			r = append(r, b[j])
+			j++
+		default:
+			r = append(r, a[i])
+			i++
+			j++
+		}
+	}
+	return r
+}
+
+// differenceSorted returns the elements of the sorted slice a that are not in the sorted slice b.
+func differenceSorted(a []int, b []int) []int {
+	r := make([]int, 0, len(a))
+	j := 0
+	for _, v := range a {
+		for j < len(b) && b[j] < v {
+			j++
+		}
+		if j == len(b) || b[j] != v {
+			r = append(r, v)
+		}
+	}
+	return r
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// randomIDs returns n distinct sorted document IDs below limit.
+func randomIDs(r *rand.Rand, n int, limit int) []int {
+	seen := make(map[int]bool, n)
+	ids := make([]int, 0, n)
+	for len(ids) < n {
+		id := r.Intn(limit)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// naiveIntersection intersects two sorted slices with a map, as a reference.
+func naiveIntersection(a []int, b []int) []int {
+	in := make(map[int]bool, len(b))
+	for _, id := range b {
+		in[id] = true
+	}
+	r := []int{}
+	for _, id := range a {
+		if in[id] {
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+func TestIntersectSorted(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sizes := [][2]int{{0, 10}, {1, 1}, {10, 10}, {10, 1000}, {1000, 10}, {3, 100000}, {500, 5000}}
+	for _, size := range sizes {
+		a, b := randomIDs(r, size[0], 200000), randomIDs(r, size[1], 200000)
+		want := naiveIntersection(a, b)
+		if got := intersectSorted(a, b); !slices.Equal(got, want) {
+			t.Errorf("intersectSorted(%d, %d ids) = %v, want %v", size[0], size[1], got, want)
+		}
+		if got := mergeIntersection(a, b); !slices.Equal(got, want) {
+			t.Errorf("mergeIntersection(%d, %d ids) = %v, want %v", size[0], size[1], got, want)
+		}
+		small, large := a, b
+		if len(small) > len(large) {
+			small, large = large, small
+		}
+		if got := gallopingIntersection(small, large); !slices.Equal(got, want) {
+			t.Errorf("gallopingIntersection(%d, %d ids) = %v, want %v", size[0], size[1], got, want)
+		}
+	}
+}
+
+func TestGallop(t *testing.T) {
+	s := []int{1, 3, 5, 7, 9, 11}
+	tests := []struct{ lo, target, want int }{
+		{0, 0, 0}, {0, 1, 0}, {0, 4, 2}, {2, 5, 2}, {2, 11, 5}, {0, 12, 6}, {6, 1, 6},
+	}
+	for _, test := range tests {
+		if got := gallop(s, test.lo, test.target); got != test.want {
+			t.Errorf("gallop(%v, %d, %d) = %d, want %d", s, test.lo, test.target, got, test.want)
+		}
+	}
+}
+
+func TestIntersectAllIgnoresOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	lists := []*PostingList{
+		NewPostingList(randomIDs(r, 50000, 100000)),
+		NewPostingList(randomIDs(r, 20, 100000)),
+		NewPostingList(randomIDs(r, 3000, 100000)),
+	}
+	want := naiveIntersection(naiveIntersection(lists[0].IDs(), lists[1].IDs()), lists[2].IDs())
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 0, 2}} {
+		ordered := []*PostingList{lists[order[0]], lists[order[1]], lists[order[2]]}
+		if got := intersectAll(ordered).IDs(); !slices.Equal(got, want) {
+			t.Errorf("intersectAll in order %v = %v, want %v", order, got, want)
+		}
+	}
+}
+
+// BenchmarkIntersectSkewed compares the linear merge the engine used to intersect every pair of lists with
+// intersectSorted, which gallops through the longer list, for a rare term ANDed with a very common one.
+func BenchmarkIntersectSkewed(b *testing.B) {
+	r := rand.New(rand.NewSource(3))
+	common := randomIDs(r, 1000000, 4000000)
+	for _, rare := range []int{10, 1000, 100000} {
+		ids := randomIDs(r, rare, 4000000)
+		b.Run(fmt.Sprintf("rare=%d/merge", rare), func(b *testing.B) {
+			for range b.N {
+				mergeIntersection(ids, common)
+			}
+		})
+		b.Run(fmt.Sprintf("rare=%d/intersectSorted", rare), func(b *testing.B) {
+			for range b.N {
+				intersectSorted(ids, common)
+			}
+		})
+	}
+}
+
+// BenchmarkUnionMany compares unioning the posting lists of the terms matching a broad wildcard pattern pair by pair
+// with Union, which copies the growing result for every list, with unionAll, which unions them at once.
+func BenchmarkUnionMany(b *testing.B) {
+	r := rand.New(rand.NewSource(5))
+	for _, bitmaps := range []int{0, 10} {
+		lists := make([]*PostingList, 2000)
+		for i := range lists {
+			if i < bitmaps {
+				lists[i] = &PostingList{bitmap: BitmapOf(randomIDs(r, 200000, 1000000))}
+			} else {
+				lists[i] = NewPostingList(randomIDs(r, 1+r.Intn(500), 1000000))
+			}
+		}
+		b.Run(fmt.Sprintf("bitmaps=%d/pairwise", bitmaps), func(b *testing.B) {
+			for range b.N {
+				result := &PostingList{}
+				for _, list := range lists {
+					result = Union(result, list)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("bitmaps=%d/unionAll", bitmaps), func(b *testing.B) {
+			for range b.N {
+				unionAll(lists)
+			}
+		})
+	}
+}
+
+// BenchmarkIntersectAll compares intersecting the lists of a query in query order with a linear merge,
+// as the engine used to, with intersectAll, which starts from the rarest list and gallops.
+func BenchmarkIntersectAll(b *testing.B) {
+	r := rand.New(rand.NewSource(4))
+	lists := []*PostingList{
+		NewPostingList(randomIDs(r, 800000, 4000000)),
+		NewPostingList(randomIDs(r, 500000, 4000000)),
+		NewPostingList(randomIDs(r, 50, 4000000)),
+	}
+	b.Run("query-order/merge", func(b *testing.B) {
+		for range b.N {
+			result := lists[0].IDs()
+			for _, list := range lists[1:] {
+				result = mergeIntersection(result, list.IDs())
+			}
+		}
+	})
+	b.Run("rarest-first/intersectAll", func(b *testing.B) {
+		for range b.N {
+			intersectAll(lists)
+		}
+	})
+}
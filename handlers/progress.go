@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of the ingest of a corpus, reported by Progress.
+const (
+	PhaseLoading  = "loading"  // Documents are read from the corpus, and indexed as they are read by Ingest.
+	PhaseResuming = "resuming" // Committed segments are read back from the checkpoint directory.
+	PhaseIndexing = "indexing" // Loaded documents are indexed by IndexDoc.
+	PhaseReady    = "ready"    // The index is complete.
+)
+
+// Progress is a snapshot of the ingest of a corpus.
+type Progress struct {
+	Phase          string        // Current phase, "" before anything started.
+	Bytes          int64         // Bytes of the corpus read so far.
+	TotalBytes     int64         // Size of the corpus, or 0 when unknown.
+	Documents      int           // Documents read or indexed so far in the phase, including the resumed ones.
+	TotalDocuments int           // Documents to index in the phase, or 0 when unknown.
+	Resumed        int           // Documents restored from committed segments instead of being indexed again.
+	Segments       int           // Segments committed to the checkpoint directory, including the resumed ones.
+	Elapsed        time.Duration // Time spent in the phase.
+	ReadTime       time.Duration // Time spent reading and parsing documents.
+	IndexTime      time.Duration // Time spent analyzing documents and adding them to the indexes.
+	HeapBytes      uint64        // Heap memory in use, mostly held by the documents and the indexes.
+}
+
+// Rate returns the number of documents processed per second in the phase.
+// Documents restored from committed segments are not counted while loading, since they are not indexed again.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	documents := p.Documents
+	if p.Phase == PhaseLoading {
+		documents -= p.Resumed
+	}
+	return float64(max(documents, 0)) / p.Elapsed.Seconds()
+}
+
+// ETA estimates the time left in the phase from the share of the bytes or documents processed so far,
+// or returns -1 when it cannot be estimated.
+func (p Progress) ETA() time.Duration {
+	done, total := float64(p.Bytes), float64(p.TotalBytes)
+	if p.TotalDocuments > 0 {
+		done, total = float64(p.Documents), float64(p.TotalDocuments)
+	}
+	if done <= 0 || total <= 0 || p.Phase == PhaseReady {
+		return -1
+	}
+	return time.Duration(float64(p.Elapsed) * (total - done) / done)
+}
+
+// progressSource is implemented by the document sources that know how much of their corpus they have read.
+type progressSource interface {
+	// BytesRead returns the number of bytes of the corpus read so far, and the size of the corpus or 0 when unknown.
+	BytesRead() (int64, int64)
+}
+
+// progressTracker records the progress of an ingest. It is safe for concurrent use, so a server can report
+// the progress while the SearchEngine is being built.
+type progressTracker struct {
+	mu       sync.Mutex
+	progress Progress
+	started  time.Time
+	source   progressSource // Source of the byte counts, or nil.
+}
+
+// start begins a phase, reading the byte counts from source when it is a progressSource.
+func (t *progressTracker) start(phase string, source DocumentSource, totalDocuments int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.source != nil {
+		t.progress.Bytes, t.progress.TotalBytes = t.source.BytesRead() // Keep the final counts of the previous phase.
+	}
+	t.progress.Phase = phase
+	t.progress.Documents = 0
+	t.progress.TotalDocuments = totalDocuments
+	t.started = time.Now()
+	t.source, _ = source.(progressSource)
+}
+
+// finish ends the last phase: the progress is frozen in the ready phase.
+func (t *progressTracker) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.started.IsZero() {
+		t.progress.Elapsed = time.Since(t.started)
+	}
+	if t.source != nil {
+		t.progress.Bytes, t.progress.TotalBytes = t.source.BytesRead()
+		t.source = nil
+	}
+	t.progress.Phase = PhaseReady
+}
+
+// update applies a change to the progress.
+func (t *progressTracker) update(change func(p *Progress)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	change(&t.progress)
+}
+
+// snapshot returns the current progress, along with the heap memory in use.
+func (t *progressTracker) snapshot() Progress {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.progress
+	p.HeapBytes = mem.HeapInuse
+	if !t.started.IsZero() && p.Phase != PhaseReady {
+		p.Elapsed = time.Since(t.started)
+	}
+	if t.source != nil {
+		p.Bytes, p.TotalBytes = t.source.BytesRead()
+	}
+	return p
+}
+
+// Progress returns the progress of the ingest of the SearchEngine. It may be called while the SearchEngine is being built.
+func (s *SearchEngine) Progress() Progress {
+	return s.progress.snapshot()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+// Read reads from the underlying reader and counts the bytes read.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countedSource adds the byte counts of the underlying file to a DocumentSource.
+type countedSource struct {
+	DocumentSource
+	counter *countingReader
+	size    int64
+}
+
+// BytesRead returns the number of bytes of the file read so far and its size.
+func (c *countedSource) BytesRead() (int64, int64) {
+	return c.counter.n.Load(), c.size
+}
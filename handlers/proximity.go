@@ -0,0 +1,124 @@
+package handlers
+
+// proximityBoost weighs the proximity score of a document: the relevance score of a document whose query terms
+// are next to each other is multiplied by 1 + proximityBoost, and the boost fades as the terms spread out.
+const proximityBoost = 0.5
+
+// nearLink is a link of a NEAR/n chain: the analyzed terms of a query term and the number of words
+// that may separate it from the next link.
+type nearLink struct {
+	terms []queryTerm
+	next  int
+}
+
+// matchesNearChain reports whether the links of a NEAR/n chain appear in the document, each one within
+// its distance of the previous one. Every position of a link reachable from the previous link is kept,
+// so "a NEAR/2 b NEAR/2 c" matches as long as some b is close to both an a and a c.
+func (s *SearchEngine) matchesNearChain(chain []nearLink, docID int) bool {
+	var reached []int
+	for i, link := range chain {
+		positions := s.termPositions(link.terms, docID)
+		if i > 0 {
+			positions = withinDistance(reached, positions, chain[i-1].next+1)
+		}
+		if len(positions) == 0 {
+			return false
+		}
+		reached = positions
+	}
+	return true
+}
+
+// termPositions returns the sorted positions at which any of the analyzed terms appears in the document.
+func (s *SearchEngine) termPositions(terms []queryTerm, docID int) []int {
+	var r []int
+	for _, term := range terms {
+		r = unionSorted(r, s.termIndex(term.Exact)[term.Term].Positions(docID))
+	}
+	return r
+}
+
+// withinDistance returns the positions of candidates that are at most distance positions away from a position of anchors.
+// Both slices must be sorted.
+func withinDistance(anchors []int, candidates []int, distance int) []int {
+	var r []int
+	j := 0
+	for _, position := range candidates {
+		for j < len(anchors) && anchors[j] < position-distance {
+			j++
+		}
+		if j < len(anchors) && anchors[j] <= position+distance {
+			r = append(r, position)
+		}
+	}
+	return r
+}
+
+// minSpan returns the width of the smallest window holding one value of every sorted list,
+// i.e. the smallest max - min over all choices of one value per list. It returns -1 if a list is empty.
+// Parameters:
+//
+//	lists: sorted slices of positions, one per query term.
+//
+// Return values:
+//
+//	int: the width of the smallest window, 0 when every list shares a value.
+func minSpan(lists [][]int) int {
+	if len(lists) == 0 {
+		return -1
+	}
+	for _, list := range lists {
+		if len(list) == 0 {
+			return -1
+		}
+	}
+	next := make([]int, len(lists)) // Index of the current value of every list.
+	best := -1
+	for {
+		lo, hi := 0, lists[0][next[0]]
+		for i, list := range lists {
+			value := list[next[i]]
+			if value < lists[lo][next[lo]] {
+				lo = i
+			}
+			hi = max(hi, value)
+		}
+		if span := hi - lists[lo][next[lo]]; best < 0 || span < best {
+			best = span
+		}
+		// Advance the list holding the smallest value; the window can only shrink by moving it.
+		next[lo]++
+		if next[lo] == len(lists[lo]) {
+			return best
+		}
+	}
+}
+
+// shiftPositions returns the positions moved by offset.
+func shiftPositions(positions []int, offset int) []int {
+	r := make([]int, len(positions))
+	for i, position := range positions {
+		r[i] = position + offset
+	}
+	return r
+}
+
+// proximityScore returns the proximity boost factor of a document for the query terms grouped by clause:
+// 1 + proximityBoost when one term of every clause can be found in consecutive positions, decreasing
+// towards 1 as the smallest window holding all the clauses widens. Queries with a single clause get no boost.
+// It also returns the width of that window, or -1 when there is none.
+func (s *SearchEngine) proximityScore(clauseTerms [][]queryTerm, docID int) (float64, int) {
+	if len(clauseTerms) < 2 {
+		return 1, -1
+	}
+	lists := make([][]int, len(clauseTerms))
+	for i, terms := range clauseTerms {
+		lists[i] = s.termPositions(terms, docID)
+	}
+	span := minSpan(lists)
+	if span < 0 {
+		return 1, -1
+	}
+	// Adjacent terms span one position less than there are clauses.
+	return 1 + proximityBoost*float64(len(clauseTerms)-1)/float64(max(span, len(clauseTerms)-1)), span
+}
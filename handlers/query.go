@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// queryClause is a single element of a regular search query.
+// Clauses are ANDed together; a clause matches a document when any of its alternatives does
+// and every term of Near is found close enough.
+type queryClause struct {
+	Alternatives []string   // Raw query terms joined with OR.
+	Exclude      bool       // The clause was prefixed with '-' or NOT and removes its matches.
+	Near         []nearTerm // Raw query terms chained to the clause with NEAR/n.
+	Synonyms     bool       // The alternatives are synonyms from expandSynonyms; those of several terms match as phrases.
+}
+
+// nearTerm is a query term joined to the previous term of its clause with NEAR/n.
+// It matches when at most Distance words separate it from the previous term, in either order.
+type nearTerm struct {
+	Term     string
+	Distance int
+}
+
+// queryTerm is an analyzed query term, looked up in the exact (unstemmed) index when Exact is set.
+type queryTerm struct {
+	Term  string
+	Exact bool
+}
+
+// parseQuery splits a regular search query into clauses.
+// Terms are ANDed by default, "a OR b" matches documents containing either term,
+// and "-a" or "NOT a" excludes documents containing the term.
+// "a NEAR/3 b" matches documents where at most 3 words separate a and b, and can be chained ("a NEAR/3 b NEAR/5 c").
+// A term prefixed with '=' ("=university") is kept as is in the alternatives and matched without stemming.
+// Parameters:
+//
+//	text: the raw search query.
+//
+// Return values:
+//
+//	[]queryClause: the parsed clauses in query order.
+func parseQuery(text string) []queryClause {
+	var clauses []queryClause
+	fields := strings.Fields(text)
+	exclude := false
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "NOT":
+			exclude = true
+			continue
+		case isNear(field) && len(clauses) > 0 && i+1 < len(fields):
+			// Chain the next term to the previous clause.
+			distance, _ := strconv.Atoi(field[len("NEAR/"):])
+			i++
+			last := &clauses[len(clauses)-1]
+			last.Near = append(last.Near, nearTerm{Term: fields[i], Distance: distance})
+			continue
+		case field == "OR" && len(clauses) > 0 && i+1 < len(fields):
+			// Attach the next term to the previous clause as an alternative.
+			i++
+			last := &clauses[len(clauses)-1]
+			last.Alternatives = append(last.Alternatives, fields[i])
+			continue
+		case len(field) > 1 && strings.HasPrefix(field, "-"):
+			exclude = true
+			field = field[1:]
+		}
+		clauses = append(clauses, queryClause{Alternatives: []string{field}, Exclude: exclude})
+		exclude = false
+	}
+	return clauses
+}
+
+// isNear reports whether the query field is a NEAR/n operator.
+func isNear(field string) bool {
+	distance, ok := strings.CutPrefix(field, "NEAR/")
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(distance)
+	return err == nil && !strings.HasPrefix(distance, "-")
+}
+
+// lookupTerm returns the posting list of a raw query term and its analyzed terms.
+// A term that analyzes to several tokens matches the documents containing all of them.
+// A term prefixed with '=' is analyzed without stemming and looked up in the exact index.
+// It returns nil when the term contains no indexable token, and an empty list when a token is not in the Index.
+func (s *SearchEngine) lookupTerm(term string, mode analysisMode) (*PostingList, []queryTerm) {
+	exact := len(term) > 1 && strings.HasPrefix(term, "=")
+	var tokens []string
+	if exact {
+		tokens = s.analyzeExact(term[1:], mode)
+	} else {
+		tokens = s.analyze(term, mode)
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	index := s.termIndex(exact)
+	terms := make([]queryTerm, 0, len(tokens))
+	lists := make([]*PostingList, 0, len(tokens))
+	for _, token := range tokens {
+		terms = append(terms, queryTerm{Term: token, Exact: exact})
+		postings, ok := index[token]
+		if !ok {
+			return &PostingList{}, terms // Token doesn't exist in Index.
+		}
+		lists = append(lists, postings)
+	}
+	return intersectAll(lists), terms
+}
+
+// matchClause returns the documents matching any alternative of the clause and the analyzed terms of
+// all its alternatives. It returns nil when none of the alternatives contains an indexable token.
+// Terms chained with NEAR/n are added to the returned terms and restrict the documents to those where they appear close enough.
+// It returns the error of the context if the context is canceled while NEAR/n terms are checked.
+func (s *SearchEngine) matchClause(ctx context.Context, clause queryClause, mode analysisMode) (*PostingList, []queryTerm, error) {
+	if len(clause.Near) > 0 {
+		return s.matchNear(ctx, clause, mode)
+	}
+	var matches *PostingList
+	var terms []queryTerm
+	for _, alternative := range clause.Alternatives {
+		postings, altTerms := s.lookupTerm(alternative, mode)
+		if clause.Synonyms {
+			var err error
+			if postings, altTerms, err = s.lookupSynonym(ctx, alternative, postings, altTerms); err != nil {
+				return nil, nil, err
+			}
+		}
+		if postings == nil {
+			continue
+		}
+		terms = append(terms, altTerms...)
+		if matches == nil {
+			matches = postings
+		} else {
+			matches = Union(matches, postings)
+		}
+	}
+	return matches, terms, nil
+}
+
+// lookupSynonym resolves a synonym of several terms, such as "united states", as a phrase, so it only matches
+// documents where its terms are adjacent. Synonyms of a single term keep the postings and terms found by lookupTerm.
+// It returns the error of the context if the context is canceled while the phrase is matched.
+func (s *SearchEngine) lookupSynonym(ctx context.Context, synonym string, postings *PostingList, terms []queryTerm) (*PostingList, []queryTerm, error) {
+	tokens := s.analyzeTokens(synonym, phraseMode)
+	if len(tokens) < 2 {
+		return postings, terms, nil
+	}
+	ids, err := s.matchPhrase(ctx, tokens, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	terms = terms[:0:0]
+	for _, token := range tokens {
+		terms = append(terms, queryTerm{Term: token.Term})
+	}
+	return NewPostingList(ids), terms, nil
+}
+
+// matchNear evaluates a clause with NEAR/n terms. Each link of the chain is resolved to a posting list,
+// the lists are intersected and the positions of the candidate documents are checked link by link.
+// Links made only of stop words are skipped and their distance is carried over to the next link.
+func (s *SearchEngine) matchNear(ctx context.Context, clause queryClause, mode analysisMode) (*PostingList, []queryTerm, error) {
+	first := clause
+	first.Near = nil
+	postings, terms, err := s.matchClause(ctx, first, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	var chain []nearLink
+	if postings != nil {
+		chain = append(chain, nearLink{terms: terms})
+	}
+	lists := []*PostingList{postings}
+	carry := 0 // Words of the skipped links.
+	for _, near := range clause.Near {
+		nearPostings, nearTerms := s.lookupTerm(near.Term, mode)
+		if nearPostings == nil {
+			carry += near.Distance + 1
+			continue
+		}
+		if postings == nil {
+			postings, lists = nearPostings, []*PostingList{nearPostings} // The chain starts here.
+		} else {
+			lists = append(lists, nearPostings)
+		}
+		if len(chain) > 0 {
+			chain[len(chain)-1].next = near.Distance + carry
+		}
+		chain = append(chain, nearLink{terms: nearTerms})
+		terms = append(terms, nearTerms...)
+		carry = 0
+	}
+	if postings == nil {
+		return nil, nil, nil
+	}
+	candidates := intersectAll(lists)
+	var ids []int
+	for i, docID := range candidates.IDs() {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, nil, err
+		}
+		if s.matchesNearChain(chain, docID) {
+			ids = append(ids, docID)
+		}
+	}
+	return NewPostingList(ids), terms, nil
+}
+
+// termIndex returns the index holding exact (unstemmed) terms when exact is set and the SearchEngine
+// keeps an exact index, and the main Index otherwise.
+func (s *SearchEngine) termIndex(exact bool) map[string]*PostingList {
+	if exact && s.ExactIndex != nil {
+		return s.ExactIndex
+	}
+	return s.Index
+}
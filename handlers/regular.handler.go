@@ -1,97 +1,213 @@
 package handlers
 
 import (
-	"math"
-	"sort"
+	"context"
+	"strings"
+	"time"
 )
 
-// Search performs a search operation based on the given text and returns a ranked list of document IDs.
-// It tokenizes the search query, calculates TF-IDF scores for documents, and ranks the documents based on the scores.
-// If the search query is empty or no matching documents are found, it returns an empty list.
-func (s *SearchEngine) Search(text string) []int {
-	// Tokenize the search query
-	queryTokens := analyze(text)
-	if len(queryTokens) == 0 {
-		return []int{}
-	}
-	// Initialize the result set with document IDs from the first token
-	var resultSet []int
-	if ids, ok := s.Index[queryTokens[0]]; ok {
-		resultSet = append(resultSet, ids...)
-	} else {
-		return nil
+// titleBoost is the share of the relevance score (TF-IDF or BM25, see Scoring) of a term added for every occurrence of the term in the document title.
+const titleBoost = 0.5
+
+// shingleBoost weighs the relevance score (TF-IDF or BM25, see Scoring) of a query shingle found in a document against the score of a single term.
+const shingleBoost = 1.0
+
+// Search performs a search operation based on the given text and returns the ranked matching documents.
+// It parses the query into clauses (terms are ANDed, "OR" joins alternatives and "-term" or "NOT term" excludes),
+// "a NEAR/n b" requires the terms within n words of each other,
+// intersects the clause posting lists starting from the rarest, calculates the relevance score (TF-IDF or BM25, see Scoring) of the documents, and ranks the documents based on the scores.
+// Documents where the query terms appear close together get a proximity boost.
+// If the search query is empty or no matching documents are found, the result has no hits.
+// It stops and returns the error of the context when the context is canceled or its deadline passes.
+// With a QueryCache, the results of queries analyzing to the same terms are reused.
+func (s *SearchEngine) Search(ctx context.Context, text string) (*SearchResult, error) {
+	return s.cached(s.regularCacheKey(text), func() (*SearchResult, error) {
+		return s.search(ctx, text)
+	})
+}
+
+// search runs a regular query without looking it up in the cache.
+func (s *SearchEngine) search(ctx context.Context, text string) (*SearchResult, error) {
+	start := time.Now()
+	query, err := s.resolveQuery(ctx, text)
+	if err != nil {
+		return nil, err
 	}
-	// Calculate intersection of document IDs for subsequent tokens
-	for _, token := range queryTokens[1:] {
-		if ids, ok := s.Index[token]; ok {
-			resultSet = Intersection(resultSet, ids)
-		} else {
-			// Token doesn't exist in Index.
-			return nil
+	resultSet := query.matches.IDs()
+	// Calculate the relevance score for each document in the result set
+	hits := make([]Hit, 0, len(resultSet))
+	for i, docID := range resultSet {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, err
 		}
+		hits = append(hits, s.newHit(query, docID))
 	}
-	// Calculate TF-IDF score for each document in the result set
-	docScores := make(map[int]float64)
-	for _, docID := range resultSet {
-		// Calculate TF-IDF score for document text
-		for _, token := range queryTokens {
-			idf := math.Log(float64(len(s.Documents)) / float64(len(s.Index[token])))
-			tf := calculateTF(token, s.Documents[docID].Text)
-			tfidf := tf * idf
-			docScores[docID] += tfidf
-			// Check if token is also in document title
-			titleTokens := analyze(s.Documents[docID].Title)
-			for _, titleToken := range titleTokens {
-				if token == titleToken {
-					// Boost score if token is in title
-					docScores[docID] += tfidf * 0.5 // Adjust the boosting factor as needed
-				}
-			}
+	return newSearchResult(hits, start), nil
+}
+
+// regularQuery is a regular search query parsed into clauses and resolved against the Index.
+type regularQuery struct {
+	mode        analysisMode
+	clauses     []queryClause
+	postings    []*PostingList // Documents matching each clause, nil for clauses without indexable tokens.
+	terms       [][]queryTerm  // Analyzed terms of each clause.
+	queryTerms  []queryTerm    // Terms of the included clauses, which are scored.
+	clauseTerms [][]queryTerm  // Terms of every included clause, for the proximity boost.
+	shingles    []string       // Shingles of adjacent query terms present in the ShingleIndex.
+	matches     *PostingList   // Documents matching the whole query.
+}
+
+// resolveQuery parses a regular search query, expands its synonyms and resolves every clause to a posting list.
+// The documents matching the query are the intersection of the included clauses, from the rarest upwards,
+// minus the documents of the excluded clauses.
+func (s *SearchEngine) resolveQuery(ctx context.Context, text string) (*regularQuery, error) {
+	query := &regularQuery{mode: queryMode, matches: &PostingList{}}
+	// Stop words are skipped, unless they are indexed and the query has nothing else, as in "the who"
+	if s.IndexStopWords && len(s.analyze(text, queryMode)) == 0 {
+		query.mode = phraseMode
+	}
+	query.clauses = parseQuery(text)
+	if s.Synonyms != nil && s.SynonymExpansion == QueryTimeSynonyms {
+		query.clauses = s.expandSynonyms(query.clauses, query.mode)
+	}
+	// Resolve every clause of the query to a posting list
+	var included, excluded []*PostingList
+	empty := false
+	for _, clause := range query.clauses {
+		postings, terms, err := s.matchClause(ctx, clause, query.mode)
+		if err != nil {
+			return nil, err
 		}
+		query.postings = append(query.postings, postings)
+		query.terms = append(query.terms, terms)
+		if postings == nil {
+			continue // The clause contains only stop words or symbols.
+		}
+		if clause.Exclude {
+			excluded = append(excluded, postings)
+			continue
+		}
+		if postings.Len() == 0 {
+			empty = true // No document matches this clause.
+		}
+		included = append(included, postings)
+		query.queryTerms = append(query.queryTerms, terms...)
+		query.clauseTerms = append(query.clauseTerms, terms)
 	}
-	// Convert map to slice for sorting
-	var results []struct {
-		DocID int
-		Score float64
+	if len(included) == 0 || empty {
+		return query, nil
 	}
-	for docID, score := range docScores {
-		results = append(results, struct {
-			DocID int
-			Score float64
-		}{docID, score})
+	// Intersect the clauses from the rarest upwards, then remove excluded documents
+	query.matches = intersectAll(included)
+	for _, postings := range excluded {
+		query.matches = Difference(query.matches, postings)
 	}
+	query.shingles = s.queryShingles(query.clauses, query.mode)
+	return query, nil
+}
 
-	// Sort results by score
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].Score > results[j].Score
-	})
+// scoreDocument calculates the relevance score (TF-IDF or BM25, see Scoring) of a document matching a regular query:
+// the weight of every query term in the text, boosted when the term is also in the title, plus the weight of the
+// query shingles, multiplied by the proximity boost.
+// When explanation is not nil, every component of the score is recorded in it.
+func (s *SearchEngine) scoreDocument(query *regularQuery, docID int, explanation *Explanation) float64 {
+	doc := s.Documents[docID]
+	score := 0.0
+	// Boost documents containing adjacent query terms next to each other
+	for _, shingle := range query.shingles {
+		postings := s.ShingleIndex[shingle]
+		if !postings.Contains(docID) {
+			continue
+		}
+		count, length := len(postings.Positions(docID)), s.textLength(docID, false)
+		tf, idf := s.termWeight(count, length, postings.Len())
+		score += tf * idf * shingleBoost
+		explanation.add(ScoreComponent{Field: "shingle", Term: shingle, Count: count, Length: length, TF: tf,
+			DocFreq: postings.Len(), IDF: idf, Boost: shingleBoost, Score: tf * idf * shingleBoost})
+	}
+	// Calculate the relevance score for document text, counting the terms from their positions in the index.
+	// The title is not indexed: it is analyzed once per document, and only when a query term is looked up in it.
+	var titleTerms, exactTitleTerms []string
+	for _, term := range query.queryTerms {
+		postings, ok := s.termIndex(term.Exact)[term.Term]
+		if !ok {
+			continue // An OR alternative that no document contains adds nothing to the score.
+		}
+		count, length := len(postings.Positions(docID)), s.textLength(docID, term.Exact)
+		tf, idf := s.termWeight(count, length, postings.Len())
+		tfidf := tf * idf
+		score += tfidf
+		explanation.add(ScoreComponent{Field: "text", Term: term.String(), Count: count, Length: length, TF: tf,
+			DocFreq: postings.Len(), IDF: idf, Boost: 1, Score: tfidf})
+		// Check if token is also in document title
+		if term.Exact && exactTitleTerms == nil {
+			exactTitleTerms = s.fieldTerms(doc.Title, true)
+		} else if !term.Exact && titleTerms == nil {
+			titleTerms = s.fieldTerms(doc.Title, false)
+		}
+		fieldTerms := titleTerms
+		if term.Exact {
+			fieldTerms = exactTitleTerms
+		}
+		titleCount, titleLength := countTerm(term.Term, fieldTerms), len(fieldTerms)
+		if titleCount > 0 {
+			// Boost score once per occurrence of the token in the title
+			score += tfidf * titleBoost * float64(titleCount)
+			explanation.add(ScoreComponent{Field: "title", Term: term.String(), Count: titleCount, Length: titleLength, TF: tf,
+				DocFreq: postings.Len(), IDF: idf, Boost: titleBoost * float64(titleCount), Score: tfidf * titleBoost * float64(titleCount)})
+		}
+	}
+	// Boost documents where the terms of the clauses appear close together
+	proximity, span := s.proximityScore(query.clauseTerms, docID)
+	if explanation != nil {
+		explanation.Proximity, explanation.Span = proximity, span
+	}
+	return score * proximity
+}
 
-	// Extract document IDs from sorted results
-	var rankedDocs []int
-	for _, result := range results {
-		rankedDocs = append(rankedDocs, result.DocID)
+// countTerm counts the occurrences of a term in the analyzed terms of a document field.
+func countTerm(term string, fieldTerms []string) int {
+	count := 0
+	for _, fieldTerm := range fieldTerms {
+		if fieldTerm == term {
+			count++
+		}
 	}
+	return count
+}
 
-	return rankedDocs
+// fieldTerms returns the terms of a document field as they are indexed, in the exact index when exact is set.
+func (s *SearchEngine) fieldTerms(text string, exact bool) []string {
+	if exact {
+		return s.analyzeExact(text, indexMode)
+	}
+	return s.analyze(text, indexMode)
 }
 
-// calculateTF calculates the term frequency (TF) of a given term in the document text.
-// It counts the occurrences of the term in the document text and divides it by the total number of tokens in the text to obtain the TF value.
-// Parameters:
-//
-//	term: the term for which the TF is calculated
-//	documentText: the text of the document in which the term frequency is calculated
-//
-// Return:
-//
-//	float64: the term frequency (TF) of the given term in the document text
-func calculateTF(term string, documentText string) float64 {
-	tokens := analyze(documentText)
-	termCount := 0
-	for _, token := range tokens {
-		if token == term {
-			termCount++
+// queryShingles returns the word shingles of the plain terms of a query that are present in the ShingleIndex.
+// Shingles are only built between terms that follow each other in the query.
+func (s *SearchEngine) queryShingles(clauses []queryClause, mode analysisMode) []string {
+	if len(s.ShingleIndex) == 0 {
+		return nil
+	}
+	var r []string
+	var run []string
+	flush := func() {
+		_, shingles := s.analyzeWithShingles(strings.Join(run, " "), mode)
+		for _, shingle := range shingles {
+			if _, ok := s.ShingleIndex[shingle.Term]; ok {
+				r = append(r, shingle.Term)
+			}
+		}
+		run = run[:0]
+	}
+	for _, clause := range clauses {
+		if isPlainClause(clause) {
+			run = append(run, clause.Alternatives[0])
+		} else {
+			flush() // Shingles never span OR, excluded or exact clauses.
 		}
 	}
-	return float64(termCount) / float64(len(tokens))
+	flush()
+	return r
 }
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// contextCheckInterval is the number of iterations of a long query loop between two checks of the context.
+const contextCheckInterval = 64
+
+// Hit is a document matching a query.
+type Hit struct {
+	DocID  int      // ID of the document.
+	Score  float64  // Relevance score (TF-IDF or BM25, see Scoring) of the document for the query.
+	Fields []string // Fields of the document containing a query term: "text" and/or "title".
+	Terms  []string // Analyzed query terms found in the document; exact terms are prefixed with '='.
+}
+
+// SearchResult is the result of a query, whatever its mode.
+// Hits are ranked by descending score, and documents with the same score by ascending ID.
+type SearchResult struct {
+	Hits    []Hit         // Matching documents, best first.
+	Total   int           // Number of matching documents.
+	Elapsed time.Duration // Time spent evaluating the query.
+}
+
+// IDs returns the document IDs of the hits, in rank order.
+func (r *SearchResult) IDs() []int {
+	ids := make([]int, len(r.Hits))
+	for i, hit := range r.Hits {
+		ids[i] = hit.DocID
+	}
+	return ids
+}
+
+// newHit scores a document matching the query and records the fields and terms that matched.
+func (s *SearchEngine) newHit(query *regularQuery, docID int) Hit {
+	e := &Explanation{}
+	hit := Hit{DocID: docID, Score: s.scoreDocument(query, docID, e)}
+	fields := make(map[string]bool)
+	terms := make(map[string]bool)
+	for _, component := range e.Components {
+		if component.Count == 0 || component.Field == "shingle" {
+			continue
+		}
+		if !fields[component.Field] {
+			fields[component.Field] = true
+			hit.Fields = append(hit.Fields, component.Field)
+		}
+		if !terms[component.Term] {
+			terms[component.Term] = true
+			hit.Terms = append(hit.Terms, component.Term)
+		}
+	}
+	return hit
+}
+
+// newSearchResult ranks the hits and returns them as a SearchResult with the time elapsed since start.
+func newSearchResult(hits []Hit, start time.Time) *SearchResult {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].DocID < hits[j].DocID
+	})
+	return &SearchResult{Hits: hits, Total: len(hits), Elapsed: time.Since(start)}
+}
+
+// checkContext returns the error of the context every contextCheckInterval iterations of a query loop,
+// so a canceled or timed out query stops without paying for a check on every iteration.
+func checkContext(ctx context.Context, iteration int) error {
+	if iteration%contextCheckInterval != 0 {
+		return nil
+	}
+	return ctx.Err()
+}
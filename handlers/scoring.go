@@ -0,0 +1,60 @@
+package handlers
+
+import "math"
+
+// Scoring selects the formula weighing a query term in a document.
+type Scoring int
+
+const (
+	// TFIDFScoring weighs a term by its frequency in the text (count / length) times log(documents / document frequency).
+	TFIDFScoring Scoring = iota
+	// BM25Scoring weighs a term with Okapi BM25: the term frequency saturates, and is normalized by the length
+	// of the text relative to the average length of the indexed texts.
+	BM25Scoring
+)
+
+// BM25 parameters: bm25K1 controls how fast the term frequency saturates, and bm25B how much long texts are penalized.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// String returns the name of the scoring formula: "tfidf" or "bm25".
+func (s Scoring) String() string {
+	if s == BM25Scoring {
+		return "bm25"
+	}
+	return "tfidf"
+}
+
+// WithScoring makes the SearchEngine rank documents with the given scoring formula instead of TF-IDF.
+func WithScoring(scoring Scoring) Option {
+	return func(s *SearchEngine) {
+		s.Scoring = scoring
+	}
+}
+
+// termWeight returns the term frequency and inverse document frequency factors of a term, whose product is its score.
+// Parameters:
+//
+//	count: the number of occurrences of the term in the text.
+//	length: the number of terms of the text.
+//	docFreq: the number of documents containing the term.
+//
+// Return values:
+//
+//	float64: the term frequency factor.
+//	float64: the inverse document frequency factor.
+func (s *SearchEngine) termWeight(count int, length int, docFreq int) (float64, float64) {
+	documents := float64(len(s.Documents))
+	if s.Scoring == BM25Scoring {
+		norm := 1.0
+		if s.averageLength > 0 {
+			norm = 1 - bm25B + bm25B*float64(length)/s.averageLength
+		}
+		tf := float64(count) * (bm25K1 + 1) / (float64(count) + bm25K1*norm)
+		idf := math.Log(1 + (documents-float64(docFreq)+0.5)/(float64(docFreq)+0.5))
+		return tf, idf
+	}
+	return float64(count) / float64(length), math.Log(documents / float64(docFreq))
+}
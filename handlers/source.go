@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DocumentSource is an iterator over the documents of a corpus, whatever its format.
+type DocumentSource interface {
+	// Next returns the next document of the source, or io.EOF once every document has been returned.
+	// The ID of the returned document is not set; the SearchEngine numbers documents in the order they are read.
+	Next() (Document, error)
+	// Close releases the files held by the source.
+	Close() error
+}
+
+// SourcePosition is a position in a corpus where a DocumentSource restarts reading: the byte offset of a bzip2
+// stream of a multistream dump or of a document of an uncompressed file (0 for a directory), and the number of
+// documents to skip from there.
+type SourcePosition struct {
+	Offset int64
+	Skip   int
+}
+
+// seekableSource is implemented by the document sources that can restart reading after the documents they returned,
+// so that a resumed ingest does not read the documents of its committed segments again.
+type seekableSource interface {
+	// Position returns the position following the last document returned by Next.
+	Position() SourcePosition
+	// Seek restarts reading at a position returned by Position for the same corpus. It is called before Next.
+	Seek(position SourcePosition) error
+}
+
+// Magic bytes of the supported compression formats.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	utf8BOM    = []byte{0xef, 0xbb, 0xbf}
+)
+
+// OpenSource opens the corpus at path as a DocumentSource. A directory is read as a collection of text and
+// Markdown files, and a multistream bzip2 dump next to its offset index is decompressed in parallel with
+// OpenMultistream. Other files may be compressed with gzip, bzip2 or zstd, and may hold an XML abstract dump,
+// a MediaWiki page export, JSON lines or CSV; the compression and the format are detected from the content
+// of the file rather than its name.
+// Parameters:
+//
+//	path: the path to the corpus file or directory.
+//
+// Return values:
+//
+//	DocumentSource: the documents of the corpus, to be closed by the caller.
+//	error: an error if the file cannot be opened or its format is not recognized.
+func OpenSource(path string) (DocumentSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return newDirectorySource(path)
+	}
+	if indexPath := multistreamIndexPath(path); indexPath != "" {
+		if _, err := os.Stat(indexPath); err == nil {
+			return OpenMultistream(path, indexPath, 0)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	counter := &countingReader{r: f}
+	buffered := bufio.NewReaderSize(counter, 1<<20)
+	r, closeReader, err := decompress(buffered)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	closeAll := func() error {
+		closeReader()
+		return f.Close()
+	}
+	source, err := openFormat(r, closeAll)
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	counted := &countedSource{DocumentSource: source, counter: counter, size: info.Size()}
+	// Compressed files can only be read from their start, but the offsets of the documents of uncompressed ones can be sought.
+	if format, ok := source.(offsetSource); ok && r == buffered {
+		return &seekableFile{countedSource: counted, file: f, format: format}, nil
+	}
+	return counted, nil
+}
+
+// offsetSource is implemented by the format sources that know the byte offset in their content of the end of
+// the last document they returned, and can go on reading from another reader starting at such an offset.
+type offsetSource interface {
+	offset() int64
+	reset(r io.Reader, offset int64)
+}
+
+// seekableFile is the DocumentSource of an uncompressed corpus file, which restarts reading at a document by
+// seeking the file rather than reading the documents before it.
+type seekableFile struct {
+	*countedSource
+	file   *os.File
+	format offsetSource
+}
+
+// Position returns the byte offset of the end of the last document returned.
+func (f *seekableFile) Position() SourcePosition {
+	return SourcePosition{Offset: f.format.offset()}
+}
+
+// Seek restarts reading the file at the byte offset of the position.
+func (f *seekableFile) Seek(position SourcePosition) error {
+	if _, err := f.file.Seek(position.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	f.counter.n.Store(position.Offset)
+	f.format.reset(bufio.NewReaderSize(f.counter, 1<<20), position.Offset)
+	return nil
+}
+
+// decompress returns a reader of the decompressed content of r, choosing the decompressor from the magic bytes
+// at the start of the content, and a function releasing the decompressor. Uncompressed content is returned as it is.
+func decompress(r *bufio.Reader) (io.Reader, func(), error) {
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { gz.Close() }, nil
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(r), func() {}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return r, func() {}, nil
+}
+
+// openFormat returns the DocumentSource reading the decompressed content r, choosing the format from its first
+// significant character: '<' for XML, '{' for JSON lines and anything else for CSV with a header row.
+// closeAll releases the underlying file when the source is closed.
+func openFormat(r io.Reader, closeAll func() error) (DocumentSource, error) {
+	buffered := bufio.NewReaderSize(r, 64*1024)
+	head, err := buffered.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+	head = bytes.TrimLeft(bytes.TrimPrefix(head, utf8BOM), " \t\r\n")
+	if len(head) == 0 {
+		return nil, errors.New("empty corpus")
+	}
+	switch head[0] {
+	case '<':
+		return newXMLSource(buffered, closeAll)
+	case '{':
+		return newJSONLSource(buffered, closeAll), nil
+	}
+	return newCSVSource(buffered, closeAll)
+}
+
+// LoadSource reads every document of the source into the SearchEngine, replacing the loaded documents,
+// and numbers them in the order they are read. The documents still have to be indexed with IndexDoc.
+// Its progress is reported by Progress.
+// Parameters:
+//
+//	source: the documents to load.
+//
+// Return values:
+//
+//	error: the first error of the source other than io.EOF, or nil if every document was read.
+func (s *SearchEngine) LoadSource(source DocumentSource) error {
+	s.progress.start(PhaseLoading, source, 0)
+	var documents []Document
+	for {
+		start := time.Now()
+		document, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+		document.ID = len(documents)
+		documents = append(documents, document)
+		s.progress.update(func(p *Progress) {
+			p.Documents = len(documents)
+			p.ReadTime += elapsed
+		})
+	}
+	s.Documents = documents
+	return nil
+}
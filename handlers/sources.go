@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// textFields are the accepted names of the text field of JSON and CSV documents, by preference.
+var textFields = []string{"text", "abstract", "body", "content"}
+
+// newXMLSource returns the source of an XML corpus: an abstract dump (<feed><doc>) or a MediaWiki page export
+// (<mediawiki><page>), told apart by their root element. Other XML documents are refused.
+func newXMLSource(r io.Reader, closeAll func() error) (DocumentSource, error) {
+	dec := xml.NewDecoder(r)
+	root, err := rootElement(dec)
+	if err != nil {
+		return nil, err
+	}
+	switch root.Name.Local {
+	case "mediawiki":
+		return newPageSource(dec, closeAll)
+	case "feed":
+		return &abstractSource{dec: dec, end: dec.InputOffset(), close: closeAll}, nil
+	}
+	return nil, fmt.Errorf("unsupported XML root element <%s>, expected <feed> or <mediawiki>", root.Name.Local)
+}
+
+// resumeXML returns a decoder of r, which starts between two elements of an XML corpus at the byte offset given,
+// and the offset in the corpus of the input of the decoder. The start tag of the root element is read first,
+// so the end tag of the root element at the end of the corpus is balanced.
+func resumeXML(root string, r io.Reader, offset int64) (*xml.Decoder, int64) {
+	start := "<" + root + ">"
+	return xml.NewDecoder(io.MultiReader(strings.NewReader(start), r)), offset - int64(len(start))
+}
+
+// rootElement returns the first start element of the XML stream.
+func rootElement(dec *xml.Decoder) (xml.StartElement, error) {
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
+
+// abstractSource streams the <doc> elements of a Wikipedia abstract dump, cleaning the markup left in the abstracts.
+type abstractSource struct {
+	dec   *xml.Decoder
+	start int64 // Offset in the dump of the input of dec.
+	end   int64 // Offset in the dump of the end of the last <doc> element returned.
+	close func() error
+}
+
+// Next decodes the next <doc> element.
+func (a *abstractSource) Next() (Document, error) {
+	// Define a temporary struct for decoding
+	type tempDocument struct {
+		Title    string `xml:"title"`
+		URL      string `xml:"url"`
+		Abstract string `xml:"abstract"`
+	}
+
+	for {
+		token, err := a.dec.Token()
+		if err != nil {
+			return Document{}, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "doc" {
+			continue
+		}
+		var tempDoc tempDocument
+		if err := a.dec.DecodeElement(&tempDoc, &start); err != nil {
+			return Document{}, err
+		}
+		a.end = a.start + a.dec.InputOffset()
+		// Convert the temporary document to an actual document, cleaning the markup left in the abstract
+		text, links := cleanWikitext(tempDoc.Abstract)
+		return Document{Title: tempDoc.Title, URL: tempDoc.URL, Text: text, Links: links}, nil
+	}
+}
+
+// offset returns the byte offset of the end of the last <doc> element returned.
+func (a *abstractSource) offset() int64 {
+	return a.end
+}
+
+// reset goes on decoding the <doc> elements from r, which starts at the given byte offset of the dump.
+func (a *abstractSource) reset(r io.Reader, offset int64) {
+	a.dec, a.start = resumeXML("feed", r, offset)
+	a.end = offset
+}
+
+// Close closes the dump.
+func (a *abstractSource) Close() error {
+	return a.close()
+}
+
+// jsonDocument is a line of a JSONL corpus. The text may be in any of the textFields.
+type jsonDocument struct {
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Text     string `json:"text"`
+	Abstract string `json:"abstract"`
+	Body     string `json:"body"`
+	Content  string `json:"content"`
+}
+
+// jsonlSource reads a corpus of JSON lines, one document per line, such as {"title": "...", "url": "...", "text": "..."}.
+type jsonlSource struct {
+	scanner *bufio.Scanner
+	line    int
+	read    int64 // Byte offset of the end of the last line scanned.
+	close   func() error
+}
+
+// newJSONLSource returns the source of the JSON lines read from r.
+func newJSONLSource(r io.Reader, closeAll func() error) *jsonlSource {
+	j := &jsonlSource{close: closeAll}
+	j.reset(r, 0)
+	return j
+}
+
+// offset returns the byte offset of the end of the last line read.
+func (j *jsonlSource) offset() int64 {
+	return j.read
+}
+
+// reset goes on reading lines from r, which starts at the given byte offset of the corpus.
+func (j *jsonlSource) reset(r io.Reader, offset int64) {
+	j.scanner = bufio.NewScanner(r)
+	j.scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	j.scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		j.read += int64(advance)
+		return advance, token, err
+	})
+	j.read = offset
+}
+
+// Next decodes the next non-empty line.
+func (j *jsonlSource) Next() (Document, error) {
+	for j.scanner.Scan() {
+		j.line++
+		if len(strings.TrimSpace(j.scanner.Text())) == 0 {
+			continue
+		}
+		line := j.scanner.Bytes()
+		if j.line == 1 {
+			line = bytes.TrimPrefix(line, utf8BOM) // openFormat only skips the byte order mark to detect the format.
+		}
+		var doc jsonDocument
+		if err := json.Unmarshal(line, &doc); err != nil {
+			return Document{}, fmt.Errorf("line %d: %w", j.line, err)
+		}
+		text := doc.Text
+		for _, alternative := range []string{doc.Abstract, doc.Body, doc.Content} {
+			if text == "" {
+				text = alternative
+			}
+		}
+		return Document{Title: doc.Title, URL: doc.URL, Text: text}, nil
+	}
+	if err := j.scanner.Err(); err != nil {
+		return Document{}, err
+	}
+	return Document{}, io.EOF
+}
+
+// Close closes the corpus.
+func (j *jsonlSource) Close() error {
+	return j.close()
+}
+
+// csvSource reads a CSV corpus whose header row names the columns. The "title" and "url" columns are optional,
+// and the text is taken from the first of the textFields present.
+type csvSource struct {
+	reader           *csv.Reader
+	start            int64 // Offset in the corpus of the input of reader.
+	title, url, text int   // Column indexes, -1 when absent.
+	close            func() error
+}
+
+// newCSVSource reads the header row of the CSV corpus read from r and returns its source.
+func newCSVSource(r io.Reader, closeAll func() error) (*csvSource, error) {
+	c := &csvSource{text: -1, close: closeAll}
+	c.reset(r, 0)
+	header, err := c.reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, string(utf8BOM))))
+		if _, ok := columns[name]; !ok {
+			columns[name] = i
+		}
+	}
+	column := func(name string) int {
+		if i, ok := columns[name]; ok {
+			return i
+		}
+		return -1
+	}
+	c.title, c.url = column("title"), column("url")
+	for _, name := range textFields {
+		if i := column(name); i >= 0 {
+			c.text = i
+			break
+		}
+	}
+	if c.text < 0 {
+		return nil, fmt.Errorf("csv: no text column, expected one of: %s", strings.Join(textFields, ", "))
+	}
+	return c, nil
+}
+
+// Next reads the next record.
+func (c *csvSource) Next() (Document, error) {
+	record, err := c.reader.Read()
+	if err != nil {
+		return Document{}, err
+	}
+	field := func(i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+	return Document{Title: field(c.title), URL: field(c.url), Text: field(c.text)}, nil
+}
+
+// offset returns the byte offset of the end of the last record read.
+func (c *csvSource) offset() int64 {
+	return c.start + c.reader.InputOffset()
+}
+
+// reset goes on reading records from r, which starts at the given byte offset of the corpus.
+func (c *csvSource) reset(r io.Reader, offset int64) {
+	c.reader = csv.NewReader(r)
+	c.reader.FieldsPerRecord = -1
+	c.reader.LazyQuotes = true
+	c.start = offset
+}
+
+// Close closes the corpus.
+func (c *csvSource) Close() error {
+	return c.close()
+}
+
+// directoryExtensions are the extensions of the files read by a directorySource.
+var directoryExtensions = map[string]bool{".txt": true, ".md": true, ".markdown": true}
+
+// directorySource reads every text and Markdown file of a directory tree as a document, in lexical order of their paths.
+// The title of a document is the first Markdown heading of the file, or the file name without its extension.
+type directorySource struct {
+	paths []string
+	sizes []int64 // Size of every file.
+	next  int
+	read  atomic.Int64 // Bytes of the files read so far.
+	size  int64        // Total size of the files.
+}
+
+// newDirectorySource lists the text and Markdown files of the directory tree at root.
+func newDirectorySource(root string) (*directorySource, error) {
+	d := &directorySource{}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && directoryExtensions[strings.ToLower(filepath.Ext(path))] {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			d.paths = append(d.paths, path)
+			d.sizes = append(d.sizes, info.Size())
+			d.size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Next reads the next file.
+func (d *directorySource) Next() (Document, error) {
+	if d.next >= len(d.paths) {
+		return Document{}, io.EOF
+	}
+	path := d.paths[d.next]
+	d.next++
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Document{}, err
+	}
+	d.read.Add(int64(len(content)))
+	text := string(content)
+	return Document{Title: fileTitle(path, text), URL: path, Text: text}, nil
+}
+
+// fileTitle returns the first Markdown heading of a file, or its name without the extension.
+func fileTitle(path string, text string) string {
+	if strings.EqualFold(filepath.Ext(path), ".txt") {
+		return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if heading, ok := strings.CutPrefix(strings.TrimSpace(line), "#"); ok {
+			if title := strings.TrimSpace(strings.TrimLeft(heading, "#")); title != "" {
+				return title
+			}
+		}
+	}
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// BytesRead returns the size of the files read so far and the total size of the files.
+func (d *directorySource) BytesRead() (int64, int64) {
+	return d.read.Load(), d.size
+}
+
+// Position returns the number of files read, as documents to skip from the start of the directory.
+func (d *directorySource) Position() SourcePosition {
+	return SourcePosition{Skip: d.next}
+}
+
+// Seek skips the files read before the position without reading them.
+func (d *directorySource) Seek(position SourcePosition) error {
+	if position.Skip > len(d.paths) {
+		return fmt.Errorf("the directory has fewer than %d files", position.Skip)
+	}
+	var read int64
+	for _, size := range d.sizes[:position.Skip] {
+		read += size
+	}
+	d.next = position.Skip
+	d.read.Store(read)
+	return nil
+}
+
+// Close does nothing: files are closed as soon as they are read.
+func (d *directorySource) Close() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"bufio"
+	"embed"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// StopWordSet is a set of stop words, looked up by their lowercase form.
+type StopWordSet map[string]struct{}
+
+//go:embed stopwords/*.txt
+var stopWordFiles embed.FS
+
+// stopWordSets holds the built-in stop word list of every language, keyed by language name.
+// The lists are parsed once when the package is initialized and shared by every analyzer.
+var stopWordSets = loadBuiltinStopWords()
+
+// loadBuiltinStopWords parses the embedded stopwords/<language>.txt files.
+func loadBuiltinStopWords() map[string]StopWordSet {
+	sets := make(map[string]StopWordSet)
+	entries, err := stopWordFiles.ReadDir("stopwords")
+	if err != nil {
+		panic(err) // The files are embedded at build time.
+	}
+	for _, entry := range entries {
+		f, err := stopWordFiles.Open(path.Join("stopwords", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+		set, err := readStopWords(f)
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+		sets[strings.TrimSuffix(entry.Name(), ".txt")] = set
+	}
+	return sets
+}
+
+// LoadStopWords reads a stop word list from a file.
+// The file holds one word per line; blank lines and lines starting with '#' or '|' are ignored,
+// as is anything after a '|' on a line, so Snowball stop word files can be used as they are.
+// Parameters:
+//
+//	path: the path of the stop word file.
+//
+// Return values:
+//
+//	StopWordSet: the stop words of the file.
+//	error: an error if the file cannot be read.
+func LoadStopWords(path string) (StopWordSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readStopWords(f)
+}
+
+// readStopWords parses a stop word list in the format described by LoadStopWords.
+func readStopWords(r io.Reader) (StopWordSet, error) {
+	set := make(StopWordSet)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '|'); i >= 0 {
+			line = line[:i] // Strip Snowball-style comments.
+		}
+		word := strings.ToLower(strings.TrimSpace(line))
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		set[word] = struct{}{}
+	}
+	return set, scanner.Err()
+}
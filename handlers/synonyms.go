@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxSynonymVariants caps the number of alternative token streams a query is expanded to.
+const maxSynonymVariants = 16
+
+// SynonymExpansion selects when synonyms are expanded.
+type SynonymExpansion int
+
+const (
+	// QueryTimeSynonyms expands queries to every synonym of their terms; documents are indexed as they are.
+	QueryTimeSynonyms SynonymExpansion = iota
+	// IndexTimeSynonyms injects the synonyms of document terms into the Index; queries are searched as they are.
+	IndexTimeSynonyms
+)
+
+// SynonymMap holds synonym rules whose terms have been analyzed with the analyzer of an index.
+// Inject expands document token streams for index-time expansion and Variants expands query token streams.
+// Synonyms are applied by the SearchEngine once stop words are dropped, rather than as a stage of the analyzer.
+type SynonymMap struct {
+	rules map[string][]*synonymRule // Rules keyed by the first term they match, longest match first.
+}
+
+// synonymRule expands one analyzed term sequence to its synonyms.
+type synonymRule struct {
+	match    []string         // Analyzed terms that trigger the rule.
+	variants []synonymVariant // Sequences the match is expanded to; equivalences include the match itself.
+}
+
+// synonymVariant is one side of a synonym rule.
+type synonymVariant struct {
+	text   string  // Text of the variant, as written in the synonym file.
+	tokens []Token // Analyzed tokens of the variant, with positions relative to the first one.
+}
+
+// wordNetSynonym matches an entry of the WordNet prolog database (wn_s.pl), such as s(108544813,1,'United States',n,1,0).
+var wordNetSynonym = regexp.MustCompile(`^s\((\d+),\d+,'((?:[^']|'')*)',`)
+
+// LoadSynonyms reads a synonym file and analyzes its entries with the given analyzer.
+// Two formats are accepted:
+//
+//   - Solr: "usa, united states, united states of america" declares equivalent terms, and
+//     "nyc => new york city" replaces the left side with the right side. Blank lines and '#' comments are ignored.
+//   - WordNet prolog (wn_s.pl): the words of every synset are equivalent.
+//
+// Multi-word synonyms are supported on both sides.
+// Parameters:
+//
+//	path: the path of the synonym file.
+//	analyzer: the analyzer of the index, without synonym expansion.
+//
+// Return values:
+//
+//	*SynonymMap: the analyzed synonym rules.
+//	error: an error if the file cannot be read or contains an invalid rule.
+func LoadSynonyms(path string, analyzer Analyzer) (*SynonymMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readSynonyms(f, analyzer)
+}
+
+// readSynonyms parses synonym rules in one of the formats described by LoadSynonyms.
+func readSynonyms(r io.Reader, analyzer Analyzer) (*SynonymMap, error) {
+	m := &SynonymMap{rules: make(map[string][]*synonymRule)}
+	synsets := make(map[string][]string)
+	var synsetOrder []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if match := wordNetSynonym.FindStringSubmatch(text); match != nil {
+			if _, ok := synsets[match[1]]; !ok {
+				synsetOrder = append(synsetOrder, match[1])
+			}
+			synsets[match[1]] = append(synsets[match[1]], strings.ReplaceAll(match[2], "''", "'"))
+			continue
+		}
+		if left, right, ok := strings.Cut(text, "=>"); ok {
+			replacements := m.variants(splitSynonyms(right), analyzer)
+			if len(replacements) == 0 {
+				return nil, fmt.Errorf("synonyms line %d: no replacement in %q", line, text)
+			}
+			for _, variant := range m.variants(splitSynonyms(left), analyzer) {
+				m.add(variant, replacements)
+			}
+			continue
+		}
+		m.addEquivalent(m.variants(splitSynonyms(text), analyzer))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range synsetOrder {
+		m.addEquivalent(m.variants(synsets[id], analyzer))
+	}
+	return m, nil
+}
+
+// splitSynonyms splits a comma-separated list of synonyms.
+func splitSynonyms(text string) []string {
+	var r []string
+	for _, word := range strings.Split(text, ",") {
+		if word = strings.TrimSpace(word); word != "" {
+			r = append(r, word)
+		}
+	}
+	return r
+}
+
+// variants analyzes synonym texts, dropping the ones without any indexable term.
+func (m *SynonymMap) variants(texts []string, analyzer Analyzer) []synonymVariant {
+	var r []synonymVariant
+	for _, text := range texts {
+		var tokens []Token
+		for _, token := range analyzer.Analyze(text) {
+			if !token.Stop {
+				tokens = append(tokens, token)
+			}
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		first := tokens[0].Position
+		for i := range tokens {
+			tokens[i].Position -= first
+		}
+		r = append(r, synonymVariant{text: text, tokens: tokens})
+	}
+	return r
+}
+
+// addEquivalent declares every variant a synonym of all the others.
+func (m *SynonymMap) addEquivalent(variants []synonymVariant) {
+	if len(variants) < 2 {
+		return
+	}
+	for _, variant := range variants {
+		m.add(variant, variants)
+	}
+}
+
+// add registers a rule expanding match to variants, merging it with an existing rule for the same terms.
+func (m *SynonymMap) add(match synonymVariant, variants []synonymVariant) {
+	terms := tokenTerms(match.tokens)
+	key := strings.Join(terms, " ")
+	rules := m.rules[terms[0]]
+	var rule *synonymRule
+	for _, existing := range rules {
+		if strings.Join(existing.match, " ") == key {
+			rule = existing
+		}
+	}
+	if rule == nil {
+		rule = &synonymRule{match: terms}
+		rules = append(rules, rule)
+		sort.SliceStable(rules, func(i, j int) bool { return len(rules[i].match) > len(rules[j].match) })
+		m.rules[terms[0]] = rules
+	}
+	for _, variant := range variants {
+		duplicate := false
+		for _, existing := range rule.variants {
+			duplicate = duplicate || strings.Join(tokenTerms(existing.tokens), " ") == strings.Join(tokenTerms(variant.tokens), " ")
+		}
+		if !duplicate {
+			rule.variants = append(rule.variants, variant)
+		}
+	}
+}
+
+// writeRules writes the analyzed rules to w, ordered by the first term they match, for the fingerprint of the
+// options of an index.
+func (m *SynonymMap) writeRules(w io.Writer) {
+	keys := make([]string, 0, len(m.rules))
+	for key := range m.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, rule := range m.rules[key] {
+			fmt.Fprintf(w, "%s =>", strings.Join(rule.match, " "))
+			for _, variant := range rule.variants {
+				fmt.Fprintf(w, " %v", variant.tokens)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// matchAt returns the longest rule matching the terms starting at index i, or nil if none does.
+func (m *SynonymMap) matchAt(terms []string, i int) *synonymRule {
+	for _, rule := range m.rules[terms[i]] {
+		if i+len(rule.match) > len(terms) {
+			continue
+		}
+		matched := true
+		for j, term := range rule.match {
+			if terms[i+j] != term {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Inject expands the synonyms of a document token stream for index-time expansion.
+// The tokens of every synonym are injected at the positions of the matched sequence, so a document
+// containing "nyc" also holds "new", "york" and "city" at consecutive positions and matches the phrase
+// "new york city". The matched tokens are kept, also for replacement rules ("a => b"): queries are not rewritten
+// with index-time expansion, so a query for "nyc" must still find them. Stop words are skipped while matching.
+func (m *SynonymMap) Inject(tokens []Token) []Token {
+	var words []int // Indexes of the tokens that are not stop words.
+	for i, token := range tokens {
+		if !token.Stop {
+			words = append(words, i)
+		}
+	}
+	terms := make([]string, len(words))
+	for i, index := range words {
+		terms[i] = tokens[index].Term
+	}
+	var injected []Token
+	for i := 0; i < len(words); {
+		rule := m.matchAt(terms, i)
+		if rule == nil {
+			i++
+			continue
+		}
+		first, last := tokens[words[i]], tokens[words[i+len(rule.match)-1]]
+		for _, variant := range rule.variants {
+			if strings.Join(tokenTerms(variant.tokens), " ") == strings.Join(rule.match, " ") {
+				continue // The matched tokens are kept.
+			}
+			for _, token := range variant.tokens {
+				token.Position += first.Position
+				token.Start, token.End = first.Start, last.End
+				injected = append(injected, token)
+			}
+		}
+		i += len(rule.match)
+	}
+	if len(injected) == 0 {
+		return tokens
+	}
+	r := make([]Token, 0, len(tokens)+len(injected))
+	seen := make(map[string]bool) // Term and position of every kept token, to skip duplicate injections.
+	for _, token := range tokens {
+		r = append(r, token)
+		seen[fmt.Sprint(token.Term, "@", token.Position)] = true
+	}
+	for _, token := range injected {
+		if key := fmt.Sprint(token.Term, "@", token.Position); !seen[key] {
+			r = append(r, token)
+			seen[key] = true
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].Position < r[j].Position })
+	return r
+}
+
+// Variants expands a query token stream for query-time expansion.
+// It returns every alternative stream obtained by replacing matched sequences with their synonyms.
+// Positions are recomputed for each alternative, so the tokens following a multi-word synonym are shifted
+// and phrase queries stay positionally correct. Rules are only matched against the terms that are not stop words;
+// stop words outside a matched sequence are carried through unchanged, so phrases such as "the who" keep them
+// when stop words are indexed. At most maxSynonymVariants streams are returned.
+func (m *SynonymMap) Variants(tokens []Token) [][]Token {
+	var words []int // Indexes of the tokens that are not stop words.
+	for i, token := range tokens {
+		if !token.Stop {
+			words = append(words, i)
+		}
+	}
+	terms := make([]string, len(words))
+	for i, index := range words {
+		terms[i] = tokens[index].Term
+	}
+	var r [][]Token
+	// expand continues the variant prefix from the token at index i, whose next word is words[w].
+	var expand func(i int, w int, prefix []Token, shift int)
+	expand = func(i int, w int, prefix []Token, shift int) {
+		if len(r) >= maxSynonymVariants {
+			return
+		}
+		if i == len(tokens) {
+			r = append(r, prefix)
+			return
+		}
+		var rule *synonymRule
+		if !tokens[i].Stop {
+			rule = m.matchAt(terms, w)
+		}
+		if rule == nil {
+			token := tokens[i]
+			token.Position += shift
+			if !token.Stop {
+				w++
+			}
+			expand(i+1, w, append(prefix[:len(prefix):len(prefix)], token), shift)
+			return
+		}
+		end := words[w+len(rule.match)-1] // Stop words inside the matched sequence are replaced with it.
+		first, last := tokens[i], tokens[end]
+		matchSpan := last.Position - first.Position + 1
+		for _, variant := range rule.variants {
+			next := prefix[:len(prefix):len(prefix)]
+			for _, token := range variant.tokens {
+				token.Position += first.Position + shift
+				token.Start, token.End = first.Start, last.End
+				next = append(next, token)
+			}
+			variantSpan := variant.tokens[len(variant.tokens)-1].Position + 1
+			expand(end+1, w+len(rule.match), next, shift+variantSpan-matchSpan)
+		}
+	}
+	expand(0, 0, nil, 0)
+	return r
+}
+
+// expandSynonyms replaces runs of query clauses that match a synonym rule with a single clause
+// whose alternatives are the synonyms, so "usa" also matches the phrase "united states". Only plain clauses,
+// without OR alternatives, exclusion or exact matching, take part in the expansion.
+func (s *SearchEngine) expandSynonyms(clauses []queryClause, mode analysisMode) []queryClause {
+	var r []queryClause
+	for i := 0; i < len(clauses); {
+		if !isPlainClause(clauses[i]) {
+			r = append(r, clauses[i])
+			i++
+			continue
+		}
+		// Collect the run of plain clauses and remember at which term each clause starts and ends.
+		var terms []string
+		starts := make(map[int]int) // Index of a clause's first term -> index of the clause.
+		ends := make(map[int]int)   // Index after a clause's last term -> index of the clause.
+		j := i
+		for ; j < len(clauses) && isPlainClause(clauses[j]); j++ {
+			clauseTerms := s.analyze(clauses[j].Alternatives[0], mode)
+			if len(clauseTerms) == 0 {
+				continue
+			}
+			starts[len(terms)] = j
+			terms = append(terms, clauseTerms...)
+			ends[len(terms)] = j
+		}
+		next := i
+		for t := 0; t < len(terms); {
+			first, isStart := starts[t]
+			rule := s.Synonyms.matchAt(terms, t)
+			last, isEnd := 0, false
+			if rule != nil {
+				last, isEnd = ends[t+len(rule.match)]
+			}
+			if !isStart || rule == nil || !isEnd {
+				t++
+				continue
+			}
+			// Keep the clauses before the match and replace the matched ones with the synonyms.
+			r = append(r, clauses[next:first]...)
+			clause := queryClause{Synonyms: true}
+			for _, variant := range rule.variants {
+				clause.Alternatives = append(clause.Alternatives, variant.text)
+			}
+			r = append(r, clause)
+			next = last + 1
+			t += len(rule.match)
+		}
+		r = append(r, clauses[next:j]...)
+		i = j
+	}
+	return r
+}
+
+// isPlainClause reports whether a query clause is a single term that is neither excluded, exact nor chained with NEAR/n.
+func isPlainClause(clause queryClause) bool {
+	return len(clause.Alternatives) == 1 && !clause.Exclude && len(clause.Near) == 0 &&
+		!strings.HasPrefix(clause.Alternatives[0], "=")
+}
+
+// tokenTerms returns the terms of the tokens.
+func tokenTerms(tokens []Token) []string {
+	terms := make([]string, len(tokens))
+	for i, token := range tokens {
+		terms[i] = token.Term
+	}
+	return terms
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSynonymsKeepIndexedStopWordsInPhrases(t *testing.T) {
+	synonyms, err := readSynonyms(strings.NewReader("tv, television\nusa, united states\n"), NewEnglishAnalyzer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithStopWordsIndexed(), WithSynonyms(synonyms, QueryTimeSynonyms))
+	s.Documents = []Document{
+		{ID: 0, Text: "The Who played in the United States"},
+		{ID: 1, Text: "Who played the guitar"},
+	}
+	s.IndexDoc()
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{`"the who"`, []int{0}},
+		{`"the usa"`, []int{0}},
+		{`"in the usa"`, []int{0}},
+	}
+	for _, test := range tests {
+		result, err := s.SearchPhrase(context.Background(), test.query)
+		if err != nil {
+			t.Fatalf("SearchPhrase(%s): %v", test.query, err)
+		}
+		var got []int
+		for _, hit := range result.Hits {
+			got = append(got, hit.DocID)
+		}
+		if len(got) != len(test.want) || (len(got) > 0 && got[0] != test.want[0]) {
+			t.Errorf("SearchPhrase(%s) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+// searchIDs returns the IDs of the documents matching a regular query, in rank order.
+func searchIDs(t *testing.T, s *SearchEngine, query string) []int {
+	t.Helper()
+	result, err := s.Search(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Search(%s): %v", query, err)
+	}
+	return result.IDs()
+}
+
+func TestMultiWordSynonymsMatchAsPhrases(t *testing.T) {
+	synonyms, err := readSynonyms(strings.NewReader("usa, united states\n"), NewEnglishAnalyzer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithSynonyms(synonyms, QueryTimeSynonyms))
+	s.Documents = []Document{
+		{ID: 0, Text: "He moved to the United States"},
+		{ID: 1, Text: "The states of the United Kingdom"},
+	}
+	s.IndexDoc()
+	if got := searchIDs(t, s, "usa"); !slices.Equal(got, []int{0}) {
+		t.Errorf("Search(usa) = %v, want [0]", got)
+	}
+}
+
+func TestIndexTimeReplacementKeepsOriginalTerms(t *testing.T) {
+	synonyms, err := readSynonyms(strings.NewReader("nyc => new york city\n"), NewEnglishAnalyzer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(WithSynonyms(synonyms, IndexTimeSynonyms))
+	s.Documents = []Document{
+		{ID: 0, Text: "Flights to NYC"},
+		{ID: 1, Text: "Flights to York"},
+	}
+	s.IndexDoc()
+	for _, query := range []string{"nyc", "new york city"} {
+		if got := searchIDs(t, s, query); !slices.Equal(got, []int{0}) {
+			t.Errorf("Search(%s) = %v, want [0]", query, got)
+		}
+	}
+}
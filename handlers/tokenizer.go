@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// runeClass is the word-boundary class of a rune, following the Unicode text segmentation
+// algorithm (UAX #29) closely enough for search.
+type runeClass int
+
+const (
+	classOther        runeClass = iota // Spaces, symbols and punctuation that always break words.
+	classLetter                        // ALetter: letters of alphabetic scripts, including Hangul.
+	classNumeric                       // Numeric: decimal digits and other numbers.
+	classKatakana                      // Katakana: joins only with other Katakana.
+	classIdeographic                   // Han and Hiragana: every character is a word on its own.
+	classExtend                        // Extend: combining marks, which stay with the preceding character.
+	classExtendNumLet                  // ExtendNumLet: connectors such as '_' that join any word characters.
+	classMidLetter                     // MidLetter: joins two letters, e.g. the middle dot.
+	classMidNum                        // MidNum: joins two numbers, e.g. the comma in "1,000".
+	classMidNumLet                     // MidNumLet: joins two letters or two numbers, e.g. '.' and the apostrophe.
+	classHyphen                        // Hyphens, which join any two word characters to keep compounds intact.
+)
+
+// classify returns the word-boundary class of r.
+func classify(r rune) runeClass {
+	switch r {
+	case '\'', '.', '\u2019', '\u2024', '\uFE52', '\uFF07', '\uFF0E':
+		return classMidNumLet
+	case '\u00B7', '\u0387', '\u05F4', '\u2027', '\uFE13', '\uFE55', '\uFF1A':
+		return classMidLetter
+	case ',', ';', '\u037E', '\u0589', '\u060C', '\u066C', '\uFE10', '\uFE14', '\uFE50', '\uFE54', '\uFF0C', '\uFF1B':
+		return classMidNum
+	case '-', '\u2010', '\u2011':
+		return classHyphen
+	case '\u200D': // Zero width joiner.
+		return classExtend
+	case '\u3031', '\u3032', '\u3033', '\u3034', '\u3035', '\u309B', '\u309C', '\u30A0', '\u30FC', '\uFF70':
+		return classKatakana // Prolonged sound and iteration marks are Katakana for word boundaries.
+	}
+	switch {
+	case unicode.In(r, unicode.Han, unicode.Hiragana):
+		return classIdeographic
+	case unicode.Is(unicode.Katakana, r):
+		return classKatakana
+	case unicode.IsLetter(r):
+		return classLetter
+	case unicode.IsNumber(r):
+		return classNumeric
+	case unicode.In(r, unicode.Mn, unicode.Mc, unicode.Me):
+		return classExtend
+	case unicode.Is(unicode.Pc, r):
+		return classExtendNumLet
+	}
+	return classOther
+}
+
+// isWordClass reports whether a rune of class c can start or continue a word.
+func isWordClass(c runeClass) bool {
+	return c == classLetter || c == classNumeric || c == classKatakana || c == classExtendNumLet
+}
+
+// joins reports whether the word character classes before and after a joining rune of class mid
+// allow the word to continue across it.
+func joins(mid runeClass, before runeClass, after runeClass) bool {
+	switch mid {
+	case classMidLetter:
+		return before == classLetter && after == classLetter
+	case classMidNum:
+		return before == classNumeric && after == classNumeric
+	case classMidNumLet:
+		return before == after && (before == classLetter || before == classNumeric)
+	case classHyphen:
+		return isWordClass(before) && isWordClass(after)
+	}
+	return false
+}
+
+// tokenize returns a slice of tokens by splitting the input text on Unicode word boundaries.
+// Words are runs of letters and numbers of any script. Following UAX #29, an apostrophe or a period between
+// two letters and a comma or a period between two numbers do not break a word, so contractions ("don't")
+// and numbers ("1,000") stay intact. Hyphens between word characters are kept as well, so compounds such as
+// "B-52" form a single token. Han and Hiragana characters are returned one per token and Katakana runs as one token.
+// Each token carries its position in the token stream and its byte offsets in the input text.
+// Parameters:
+//
+//	text: a string representing the input text to be tokenized.
+//
+// Return values:
+//
+//	[]Token: a slice of tokens obtained after splitting the input text.
+func tokenize(text string) []Token {
+	var tokens []Token
+	emit := func(start, end int) {
+		tokens = append(tokens, Token{Term: text[start:end], Position: len(tokens), Start: start, End: end})
+	}
+	start := -1        // Byte offset of the word being read, or -1 between words.
+	last := classOther // Class of the last word character of the word being read.
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		class := classify(r)
+		switch {
+		case class == classExtend:
+			// Combining marks never break a word.
+		case class == classIdeographic:
+			if start >= 0 {
+				emit(start, i)
+				start = -1
+			}
+			end := i + size
+			for end < len(text) {
+				next, nextSize := utf8.DecodeRuneInString(text[end:])
+				if classify(next) != classExtend {
+					break
+				}
+				end += nextSize
+			}
+			emit(i, end)
+			i = end
+			continue
+		case isWordClass(class):
+			if start >= 0 && (class == classKatakana) != (last == classKatakana) &&
+				class != classExtendNumLet && last != classExtendNumLet {
+				// Katakana only joins with Katakana.
+				emit(start, i)
+				start = -1
+			}
+			if start < 0 {
+				start = i
+			}
+			last = class
+		case start >= 0 && class >= classMidLetter:
+			next, nextSize := utf8.DecodeRuneInString(text[i+size:])
+			if nextSize > 0 && joins(class, last, classify(next)) {
+				i += size
+				continue // The joining character belongs to the word.
+			}
+			emit(start, i)
+			start = -1
+		default:
+			if start >= 0 {
+				emit(start, i)
+				start = -1
+			}
+		}
+		i += size
+	}
+	if start >= 0 {
+		emit(start, len(text))
+	}
+	return tokens
+}
+
+// normalizeFilter applies Unicode NFKC normalization to the input tokens, so compatibility characters
+// such as ligatures, full-width letters and superscript digits become their plain equivalents.
+func normalizeFilter(tokens []Token) []Token {
+	r := make([]Token, len(tokens))
+	for i, token := range tokens {
+		token.Term = norm.NFKC.String(token.Term)
+		r[i] = token
+	}
+	return r
+}
+
+// foldAccentsFilter removes diacritics from the input tokens, so "café" and "cafe" share a term.
+// Every term is decomposed (NFD), stripped of its combining marks and recomposed (NFC).
+// Typographic apostrophes are folded to the ASCII apostrophe as well.
+func foldAccentsFilter(tokens []Token) []Token {
+	r := make([]Token, len(tokens))
+	for i, token := range tokens {
+		token.Term = foldAccents(token.Term)
+		r[i] = token
+	}
+	return r
+}
+
+// foldAccents removes the diacritics of a single word.
+func foldAccents(word string) string {
+	decomposed := norm.NFD.String(word)
+	folded := strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1 // Drop combining marks.
+		}
+		if r == '\u2019' || r == '\u2018' {
+			return '\''
+		}
+		return r
+	}, decomposed)
+	return norm.NFC.String(folded)
+}
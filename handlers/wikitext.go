@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	wikiCommentRegex  = regexp.MustCompile(`(?s)<!--.*?-->`)
+	wikiRefRegex      = regexp.MustCompile(`(?is)<ref[^>]*/>|<ref[^>]*>.*?</ref>`)
+	wikiTagRegex      = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	wikiLinkRegex     = regexp.MustCompile(`\[\[([^\[\]|]*)(?:\|([^\[\]]*))?\]\]`)
+	wikiExternalRegex = regexp.MustCompile(`\[(?:https?:)?//[^\s\]]*\s*([^\]]*)\]`)
+	wikiHeadingRegex  = regexp.MustCompile(`(?m)^=+\s*(.*?)\s*=+\s*$`)
+	wikiMagicRegex    = regexp.MustCompile(`__[A-Z]+__`)
+	wikiListRegex     = regexp.MustCompile(`(?m)^[*#:;]+\s*`)
+	wikiResidueRegex  = regexp.MustCompile(`(?m)^\s*[|!].*$`)
+	wikiSpaceRegex    = regexp.MustCompile(`[ \t]{2,}`)
+	wikiBlankRegex    = regexp.MustCompile(`\n{3,}`)
+)
+
+// wikiDroppedNamespaces are the link prefixes of files, categories and other non-article pages,
+// whose links are removed with their caption instead of being replaced by their anchor text.
+var wikiDroppedNamespaces = map[string]bool{
+	"file": true, "image": true, "media": true, "category": true, "wikipedia": true, "wp": true,
+	"template": true, "help": true, "portal": true, "special": true, "user": true, "talk": true,
+}
+
+// cleanWikitext converts wikitext to plain text, so markup does not end up in the index, and extracts its internal links.
+// Comments, references, templates, tables, HTML tags, magic words and list markers are removed; internal and
+// external links are replaced by their anchor text, except for links to files and categories which are dropped;
+// bold, italic and heading markup is dropped, and HTML entities are decoded. Leftovers of truncated templates
+// and tables, such as lines starting with '|', are removed as well.
+// Parameters:
+//
+//	text: the wikitext of a page or an abstract.
+//
+// Return values:
+//
+//	string: the plain text.
+//	[]string: the titles of the articles the internal links point to, in order of first appearance, without duplicates.
+func cleanWikitext(text string) (string, []string) {
+	text = wikiCommentRegex.ReplaceAllString(text, "")
+	text = wikiRefRegex.ReplaceAllString(text, "")
+	text = removeNested(text, "{{", "}}")
+	text = removeNested(text, "{|", "|}")
+	text = strings.ReplaceAll(text, "}}", "")
+	text, links := replaceLinks(text)
+	text = wikiExternalRegex.ReplaceAllString(text, "$1")
+	text = wikiTagRegex.ReplaceAllString(text, "")
+	text = strings.ReplaceAll(text, "'''", "")
+	text = strings.ReplaceAll(text, "''", "")
+	text = wikiHeadingRegex.ReplaceAllString(text, "$1")
+	text = wikiMagicRegex.ReplaceAllString(text, "")
+	text = wikiListRegex.ReplaceAllString(text, "")
+	text = wikiResidueRegex.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = wikiSpaceRegex.ReplaceAllString(text, " ")
+	text = wikiBlankRegex.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text), links
+}
+
+// removeNested removes every span between the open and close delimiters, including nested spans,
+// such as templates within templates. An unclosed span, as found in truncated abstracts, is only removed
+// up to the end of its line, so the text following it is kept.
+func removeNested(text string, open string, close string) string {
+	var b strings.Builder
+	depth := 0
+	outer := 0 // Start of the outermost open span.
+	for i := 0; i < len(text); {
+		switch {
+		case strings.HasPrefix(text[i:], open):
+			if depth == 0 {
+				outer = i
+			}
+			depth++
+			i += len(open)
+		case depth > 0 && strings.HasPrefix(text[i:], close):
+			depth--
+			i += len(close)
+		default:
+			if depth == 0 {
+				b.WriteByte(text[i])
+			}
+			i++
+		}
+	}
+	if depth > 0 {
+		if end := strings.IndexByte(text[outer:], '\n'); end >= 0 {
+			b.WriteString(removeNested(text[outer+end:], open, close))
+		}
+	}
+	return b.String()
+}
+
+// replaceLinks replaces internal links by their anchor text: "[[target|anchor]]" by "anchor" and "[[target]]" by "target".
+// Links to files, categories and other non-article namespaces are removed, along with their caption.
+// Innermost links are replaced first, so links nested in captions are handled.
+// It returns the text and the normalized titles of the linked articles, in order of first appearance.
+func replaceLinks(text string) (string, []string) {
+	var links []string
+	seen := make(map[string]bool)
+	for {
+		replaced := wikiLinkRegex.ReplaceAllStringFunc(text, func(link string) string {
+			match := wikiLinkRegex.FindStringSubmatch(link)
+			target, anchor := match[1], match[2]
+			if namespace, _, ok := strings.Cut(target, ":"); ok && wikiDroppedNamespaces[strings.ToLower(strings.TrimSpace(namespace))] {
+				return ""
+			}
+			if title := linkTitle(target); title != "" && !seen[title] {
+				seen[title] = true
+				links = append(links, title)
+			}
+			if anchor != "" {
+				return anchor
+			}
+			return strings.TrimPrefix(target, ":")
+		})
+		if replaced == text {
+			return text, links
+		}
+		text = replaced
+	}
+}
+
+// linkTitle normalizes the target of an internal link to the title of the article, like MediaWiki does:
+// the section anchor is dropped, underscores become spaces and the first letter is capitalized.
+// It returns "" for links to a section of the same page.
+func linkTitle(target string) string {
+	target, _, _ = strings.Cut(target, "#")
+	target = strings.Join(strings.Fields(strings.ReplaceAll(strings.TrimPrefix(target, ":"), "_", " ")), " ")
+	if target == "" {
+		return ""
+	}
+	first, size := utf8.DecodeRuneInString(target)
+	return string(unicode.ToUpper(first)) + target[size:]
+}
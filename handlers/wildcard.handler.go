@@ -1,29 +1,81 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"regexp"
 	"strings"
+	"time"
 )
 
+// ErrInvalidQuery is returned, wrapped with the reason, for queries that cannot be evaluated.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// wildcardRegexp compiles a wildcard pattern into an anchored regular expression: '*' matches any sequence of
+// characters and every other character matches itself, so patterns such as "c++*" are not read as regular expressions.
+func wildcardRegexp(pattern string) (*regexp.Regexp, error) {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	re, err := regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	return re, nil
+}
+
 // FindWildcardMatches finds matches for wildcard token in the Index.
-// It replaces the wildcard character '*' with '.*' to create a wildcard pattern,
-// compiles the pattern into a regular expression, and then iterates through the Index
-// to find tokens that match the wildcard pattern.
+// It compiles the wildcard token into a regular expression with wildcardRegexp, and then iterates through the Index
+// to find tokens that match the wildcard pattern. The posting lists of all matching
+// tokens are combined at once with unionAll, so every document appears once, and every document is
+// ranked by the relevance score (TF-IDF or BM25, see Scoring) of the matching tokens it contains. With a QueryCache, the results of
+// the same pattern are reused.
 // Parameters:
 //
+//	ctx: the context of the query; expansion and scoring stop when it is canceled or its deadline passes
 //	wildcardToken: the wildcard token to be matched in the Index
 //
 // Return:
 //
-//	[]int: a slice of integers representing the matches found in the Index
-func (s *SearchEngine) FindWildcardMatches(wildcardToken string) []int {
-	var wildcardMatches []int
-	wildcardPattern := strings.ReplaceAll(wildcardToken, "*", ".*")
-	wildcardRegex := regexp.MustCompile("^" + wildcardPattern + "$")
-	for token := range s.Index {
+//	*SearchResult: the documents containing a matching token
+//	error: ErrInvalidQuery if the token cannot be compiled, or the error of the context if it ended before the search completed
+func (s *SearchEngine) FindWildcardMatches(ctx context.Context, wildcardToken string) (*SearchResult, error) {
+	return s.cached("wildcard:"+wildcardToken, func() (*SearchResult, error) {
+		return s.findWildcardMatches(ctx, wildcardToken)
+	})
+}
+
+// findWildcardMatches runs a wildcard query without looking it up in the cache.
+func (s *SearchEngine) findWildcardMatches(ctx context.Context, wildcardToken string) (*SearchResult, error) {
+	start := time.Now()
+	wildcardRegex, err := wildcardRegexp(wildcardToken)
+	if err != nil {
+		return nil, err
+	}
+	docTerms := make(map[int][]queryTerm) // Matching tokens of every document, for scoring.
+	var lists []*PostingList
+	i := 0
+	for token, postings := range s.Index {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, err
+		}
+		i++
 		if wildcardRegex.MatchString(token) {
-			wildcardMatches = append(wildcardMatches, s.Index[token]...)
+			lists = append(lists, postings)
+			for _, docID := range postings.IDs() {
+				docTerms[docID] = append(docTerms[docID], queryTerm{Term: token})
+			}
+		}
+	}
+	wildcardMatches := unionAll(lists)
+	hits := make([]Hit, 0, wildcardMatches.Len())
+	for i, docID := range wildcardMatches.IDs() {
+		if err := checkContext(ctx, i); err != nil {
+			return nil, err
 		}
+		hits = append(hits, s.newHit(&regularQuery{queryTerms: docTerms[docID]}, docID))
 	}
-	return wildcardMatches
+	return newSearchResult(hits, start), nil
 }
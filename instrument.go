@@ -0,0 +1,112 @@
+package main
+
+import (
+	"FullText_SearchEngine/handlers"
+	"FullText_SearchEngine/metrics"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serverMetrics holds the metrics served on the "/metrics" path.
+var serverMetrics = metrics.NewRegistry()
+
+var (
+	httpRequests = serverMetrics.NewCounterVec("http_requests_total",
+		"Number of HTTP requests by route and status code.", "route", "code")
+	httpDuration = serverMetrics.NewHistogramVec("http_request_duration_seconds",
+		"Latency of HTTP requests by route.", metrics.DefaultBuckets, "route")
+	searchQueries = serverMetrics.NewCounterVec("search_queries_total",
+		"Number of search queries by mode (regular, phrase or wildcard) and outcome (ok, invalid, timeout or canceled).", "mode", "outcome")
+	searchDuration = serverMetrics.NewHistogramVec("search_query_duration_seconds",
+		"Latency of search queries by mode.", metrics.DefaultBuckets, "mode")
+	searchResults = serverMetrics.NewHistogramVec("search_results",
+		"Number of documents matching a search query, by mode.", []float64{0, 1, 10, 100, 1000, 10000, 100000}, "mode")
+	indexSize = serverMetrics.NewGaugeVec("search_index_size",
+		"Size of the index: documents, terms, postings and positions of the main index, and terms and postings of the exact and shingle indexes.",
+		"index", "kind")
+	loadDuration = serverMetrics.NewGaugeVec("search_load_duration_seconds",
+		"Time spent reading the documents at startup.")
+	indexDuration = serverMetrics.NewGaugeVec("search_index_build_duration_seconds",
+		"Time spent indexing the documents at startup.")
+)
+
+func init() {
+	serverMetrics.RegisterRuntime()
+	cacheStat := func(field func(handlers.CacheStats) float64) func() float64 {
+		return func() float64 {
+			if SearchEngine == nil || SearchEngine.Cache == nil {
+				return 0
+			}
+			return field(SearchEngine.Cache.Stats())
+		}
+	}
+	serverMetrics.NewCounterFunc("search_cache_hits_total", "Number of queries answered from the result cache.",
+		cacheStat(func(stats handlers.CacheStats) float64 { return float64(stats.Hits) }))
+	serverMetrics.NewCounterFunc("search_cache_misses_total", "Number of queries not found in the result cache.",
+		cacheStat(func(stats handlers.CacheStats) float64 { return float64(stats.Misses) }))
+	serverMetrics.NewCounterFunc("search_cache_evictions_total", "Number of results evicted from the result cache when it is full.",
+		cacheStat(func(stats handlers.CacheStats) float64 { return float64(stats.Evictions) }))
+	serverMetrics.NewGaugeFunc("search_cache_entries", "Number of results in the result cache.",
+		cacheStat(func(stats handlers.CacheStats) float64 { return float64(stats.Entries) }))
+}
+
+// recordIndexStats sets the index size metrics from the indexes of the SearchEngine.
+func recordIndexStats(engine *handlers.SearchEngine) {
+	stats := engine.IndexStats()
+	indexSize.Set(float64(stats.Documents), "main", "documents")
+	indexSize.Set(float64(stats.Terms), "main", "terms")
+	indexSize.Set(float64(stats.Postings), "main", "postings")
+	indexSize.Set(float64(stats.Positions), "main", "positions")
+	indexSize.Set(float64(stats.ExactTerms), "exact", "terms")
+	indexSize.Set(float64(stats.ExactPostings), "exact", "postings")
+	indexSize.Set(float64(stats.Shingles), "shingle", "terms")
+	indexSize.Set(float64(stats.ShingleCount), "shingle", "postings")
+}
+
+// recordQuery records the outcome, latency and result count of a search query.
+func recordQuery(mode string, elapsed time.Duration, result *handlers.SearchResult, err error) {
+	switch {
+	case errors.Is(err, handlers.ErrInvalidQuery):
+		searchQueries.Inc(mode, "invalid")
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		searchQueries.Inc(mode, "timeout")
+		return
+	case err != nil:
+		searchQueries.Inc(mode, "canceled")
+		return
+	}
+	searchQueries.Inc(mode, "ok")
+	searchDuration.Observe(elapsed.Seconds(), mode)
+	searchResults.Observe(float64(result.Total), mode)
+}
+
+// statusRecorder is a http.ResponseWriter remembering the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it.
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument wraps the handler of a route to count its requests by status code, observe their latency
+// and write them to the access and query logs.
+func instrument(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		request, info := withRequestInfo(request)
+		handler.ServeHTTP(recorder, request)
+		elapsed := time.Since(start)
+		httpRequests.Inc(route, strconv.Itoa(recorder.status))
+		httpDuration.Observe(elapsed.Seconds(), route)
+		logRequest(route, recorder.status, elapsed, info)
+	})
+}
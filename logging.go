@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// logger writes the structured logs of the server as JSON lines on the standard error.
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+// requestInfo collects the details of a request that only its handler knows, for the access and query logs.
+type requestInfo struct {
+	query string // Search query, if any.
+	mode  string // Query mode of a search: "regular", "phrase" or "wildcard".
+	hits  int    // Number of documents matching the search query.
+	err   error  // Error of a query that did not complete.
+}
+
+// requestInfoKey is the context key of the requestInfo of a request.
+type requestInfoKey struct{}
+
+// withRequestInfo returns a copy of the request carrying an empty requestInfo for its handler to fill.
+func withRequestInfo(request *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{}
+	return request.WithContext(context.WithValue(request.Context(), requestInfoKey{}, info)), info
+}
+
+// requestInfoOf returns the requestInfo of a request, or a throwaway one when the request is not logged,
+// so handlers can fill it unconditionally.
+func requestInfoOf(request *http.Request) *requestInfo {
+	if info, ok := request.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// logRequest writes the access log line of a request, and appends searches to the query log.
+// Parameters:
+//
+//	route: the route that handled the request.
+//	status: the status code of the response.
+//	elapsed: the time spent handling the request.
+//	info: the details filled in by the handler.
+func logRequest(route string, status int, elapsed time.Duration, info *requestInfo) {
+	if !accessLog && queryLog == nil {
+		return
+	}
+	if accessLog {
+		attrs := []slog.Attr{
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", milliseconds(elapsed)),
+		}
+		if info.query != "" {
+			attrs = append(attrs, slog.String("query", info.query))
+		}
+		if info.mode != "" {
+			attrs = append(attrs, slog.String("mode", info.mode), slog.Int("hits", info.hits))
+		}
+		if info.err != nil {
+			attrs = append(attrs, slog.String("error", info.err.Error()))
+		}
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
+	}
+	if queryLog != nil && info.mode != "" {
+		entry := QueryLogEntry{
+			Time:      time.Now().UTC(),
+			Query:     info.query,
+			Mode:      info.mode,
+			Hits:      info.hits,
+			LatencyMs: milliseconds(elapsed),
+			Status:    status,
+		}
+		if err := queryLog.Write(entry); err != nil {
+			logger.Error("cannot write the query log", "error", err)
+		}
+	}
+}
+
+// milliseconds converts a duration to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// QueryLogEntry is a line of the query log: a search query received by the server and its outcome.
+// The log is written in JSONL, one entry per line, so it can be replayed later.
+type QueryLogEntry struct {
+	Time      time.Time `json:"time"`
+	Query     string    `json:"query"`
+	Mode      string    `json:"mode"`       // "regular", "phrase" or "wildcard".
+	Hits      int       `json:"hits"`       // Number of matching documents.
+	LatencyMs float64   `json:"latency_ms"` // Time spent handling the request, in milliseconds.
+	Status    int       `json:"status"`     // Status code of the response.
+}
+
+// QueryLog appends QueryLogEntry lines to a file. It is safe for concurrent use.
+type QueryLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// queryLog is the query log of the server, or nil when -query-log is not set.
+var queryLog *QueryLog
+
+// OpenQueryLog opens the query log at path for appending, creating it if needed.
+func OpenQueryLog(path string) (*QueryLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Write appends an entry to the log. Entries are written unbuffered, so the log survives a crash of the server.
+func (l *QueryLog) Write(entry QueryLogEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.encoder.Encode(entry)
+}
+
+// Close closes the log file.
+func (l *QueryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
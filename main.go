@@ -4,52 +4,356 @@ import (
 	"FullText_SearchEngine/handlers"
 	"FullText_SearchEngine/views"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/a-h/templ"
+	"io"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 var SearchEngine *handlers.SearchEngine
 
 var searchFilePath string
 
-// init initializes the searchFilePath variable by parsing the command-line flags.
+var engineConfig = engineSettings{
+	analyzer:         handlers.AnalyzerConfig{Language: "english", Stemmer: "snowball"},
+	synonymExpansion: "query",
+	scoring:          "tfidf",
+	cacheSize:        1000,
+	cacheTTL:         5 * time.Minute,
+}
+
+var queryTimeout time.Duration
+
+var accessLog bool
+
+var queryLogPath string
+
+var checkpointDir string
+
+var segmentSize int
+
+var progressInterval time.Duration
+
+var benchConfig benchOptions
+
+var evalConfig evalOptions
+
+// init initializes the search engine configuration variables by parsing the command-line flags.
 func init() {
-	flag.StringVar(&searchFilePath, "file", "", "Path to the XML file for search engine initialization")
+	flag.StringVar(&searchFilePath, "file", "", "Path to the corpus to index: a Wikipedia abstract or pages-articles dump, JSON lines, CSV or a directory of text files, optionally gzip, bzip2 or zstd-compressed")
+	engineConfig.register(flag.CommandLine)
+	flag.DurationVar(&queryTimeout, "timeout", 5*time.Second, "Maximum time spent on a query before it is abandoned, or 0 for no limit")
+	flag.BoolVar(&accessLog, "access-log", true, "Log every request as a JSON line on the standard error")
+	flag.StringVar(&queryLogPath, "query-log", "", "Path to a JSONL file search queries are appended to, for replaying them later")
+	flag.StringVar(&benchConfig.queries, "queries", "", "bench: path to the JSONL query log to replay")
+	flag.StringVar(&benchConfig.url, "url", "", "bench: URL of the server to replay the queries against, instead of an in-process index of -file")
+	flag.StringVar(&benchConfig.compare, "compare", "", "bench: second index build to compare the results with: a server URL, or a document file indexed in-process")
+	flag.IntVar(&benchConfig.concurrency, "concurrency", 1, "bench: number of queries run at the same time")
+	flag.IntVar(&benchConfig.repeat, "repeat", 1, "bench: number of times the query log is replayed")
+	flag.StringVar(&checkpointDir, "checkpoint-dir", "", "Directory the index is committed to while it is built, so an interrupted build resumes from the last committed segment")
+	flag.IntVar(&segmentSize, "segment-size", handlers.DefaultSegmentSize, "Number of documents committed at a time to -checkpoint-dir")
+	flag.DurationVar(&progressInterval, "progress", 10*time.Second, "Interval between ingest progress lines on the standard error, or 0 to disable them")
+	flag.IntVar(&benchConfig.topK, "k", 10, "bench: number of top hits compared between the two index builds; eval: rank cutoff of P@k and nDCG@k")
+	flag.StringVar(&evalConfig.qrels, "qrels", "", "eval: path to a TREC qrels file: \"topic iteration document relevance\" lines")
+	flag.StringVar(&evalConfig.topics, "topics", "", "eval: path to the queries to evaluate: \"topic query\" lines")
+	flag.StringVar(&evalConfig.scorers, "scorers", "tfidf,bm25", "eval: comma-separated scoring formulas to compare")
+	flag.StringVar(&evalConfig.variant, "variant", "", "bench: flags of the second in-process index build; eval: flags of a second index configuration to compare, e.g. \"-shingles 2\"")
 	flag.Parse()
 }
 
 // main is the entry point of the application.
 func main() {
+	// Run the subcommand, if any, instead of the server.
+	switch flag.Arg(0) {
+	case "analyze":
+		runAnalyze(flag.Args()[1:])
+		return
+	case "bench":
+		runBench(flag.Args()[1:])
+		return
+	case "eval":
+		runEval(flag.Args()[1:])
+		return
+	}
+
 	// Check if the searchFilePath is provided as a command-line flag.
 	if searchFilePath == "" {
 		fmt.Println("Usage: ./yourApp -file <path_to_xml_file>")
+		fmt.Println("       ./yourApp analyze [flags] <text>")
+		fmt.Println("       ./yourApp bench [flags] -queries <query_log.jsonl>")
+		fmt.Println("       ./yourApp eval [flags] -qrels <qrels> -topics <topics>")
 		return
 	}
 
-	// Initialize the SearchEngine using the provided searchFilePath.
-	SearchEngine = handlers.NewSearchEngine(searchFilePath)
+	options, err := engineConfig.options()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	// Create an index page view with the number of documents in the SearchEngine.
-	indexPage := views.Index(strconv.Itoa(len(SearchEngine.Documents)))
+	// Commit the index while it is built, if asked to.
+	if checkpointDir != "" {
+		options = append(options, handlers.WithCheckpoints(checkpointDir, segmentSize))
+	}
+
+	// Open the query log, if any.
+	if queryLogPath != "" {
+		queryLog, err = OpenQueryLog(queryLogPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer queryLog.Close()
+	}
 
-	// Handle the root path with the indexPage view.
-	http.Handle("/", templ.Handler(indexPage))
+	// Create the SearchEngine; the documents of searchFilePath are ingested once the server is listening.
+	SearchEngine = handlers.New(options...)
+
+	// Handle the root path with an index page view showing the number of documents in the SearchEngine.
+	http.Handle("/", instrument("/", whenReady(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		views.Index(strconv.Itoa(len(SearchEngine.Documents))).Render(request.Context(), writer)
+	}))))
 
 	// Handle the "/search" path with the SearchHandler function.
-	http.Handle("/search", http.HandlerFunc(SearchHandler))
+	http.Handle("/search", instrument("/search", whenReady(http.HandlerFunc(SearchHandler))))
 
 	// Handle the "/doc" path with the DocHandler function.
-	http.Handle("/doc", http.HandlerFunc(DocHandler))
+	http.Handle("/doc", instrument("/doc", whenReady(http.HandlerFunc(DocHandler))))
+
+	// Handle the "/explain" path with the ExplainHandler function.
+	http.Handle("/explain", instrument("/explain", whenReady(http.HandlerFunc(ExplainHandler))))
+
+	// Handle the "/analyze" path with the AnalyzeHandler function.
+	http.Handle("/analyze", instrument("/analyze", whenReady(http.HandlerFunc(AnalyzeHandler))))
+
+	// Handle the "/status" path with the progress of the ingest, served while the server is warming up.
+	http.Handle("/status", instrument("/status", http.HandlerFunc(StatusHandler)))
+
+	// Handle the "/metrics" path with the Prometheus metrics of the server.
+	http.Handle("/metrics", serverMetrics.Handler())
+
+	// Start the HTTP server and listen on port 3000 while the index is built.
+	go func() {
+		if err := http.ListenAndServe(":3000", nil); err != nil {
+			logger.Error("server stopped", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Ingest the documents, reporting the progress on the standard error.
+	done := make(chan struct{})
+	if progressInterval > 0 {
+		go reportProgress(SearchEngine, progressInterval, done)
+	}
+	err = SearchEngine.Ingest(searchFilePath)
+	close(done)
+	if err != nil {
+		logger.Error("cannot index the documents", "error", err)
+		os.Exit(1)
+	}
+	progress := SearchEngine.Progress()
+	loadDuration.Set(progress.ReadTime.Seconds())
+	indexDuration.Set(progress.IndexTime.Seconds())
+	recordIndexStats(SearchEngine)
+	ready.Store(true)
+
+	// Log that the index is ready and served on port 3000.
+	logger.Info("ready", "addr", ":3000", "documents", len(SearchEngine.Documents), "elapsed", progress.Elapsed.Round(time.Millisecond).String())
+
+	// Serve until the server stops.
+	select {}
+}
+
+// engineSettings holds the command-line flags that configure a SearchEngine: its analyzer, index and scoring.
+type engineSettings struct {
+	analyzer         handlers.AnalyzerConfig // Language, stemmer, number normalization, shingles and n-grams.
+	stopWords        string                  // Path to a stop word file replacing the built-in list, or "".
+	indexStopWords   bool                    // Whether stop words are indexed.
+	synonyms         string                  // Path to a synonym file, or "".
+	synonymExpansion string                  // When synonyms are expanded: query or index.
+	exactIndex       bool                    // Whether the unstemmed shadow index is built.
+	scoring          string                  // Formula ranking the results: tfidf or bm25.
+	cacheSize        int                     // Number of cached query results, or 0 to disable the cache.
+	cacheTTL         time.Duration           // Time a cached query result is reused, or 0 for no limit.
+}
+
+// register defines the flags of the settings on flags, with the current settings as defaults.
+func (c *engineSettings) register(flags *flag.FlagSet) {
+	flags.StringVar(&c.analyzer.Language, "lang", c.analyzer.Language, "Language of the documents, one of: "+strings.Join(handlers.Languages(), ", "))
+	flags.StringVar(&c.analyzer.Stemmer, "stemmer", c.analyzer.Stemmer, "Stemmer of the index, one of: "+strings.Join(handlers.Stemmers(), ", "))
+	flags.BoolVar(&c.analyzer.NormalizeNumbers, "normalize-numbers", c.analyzer.NormalizeNumbers, "Normalize numeric tokens, e.g. \"007\" to \"7\" and \"1960s\" to \"1960\"")
+	flags.StringVar(&c.stopWords, "stopwords", c.stopWords, "Path to a stop word file, one word per line, replacing the built-in list of the language")
+	flags.BoolVar(&c.indexStopWords, "index-stopwords", c.indexStopWords, "Index stop words so they can be searched inside phrases")
+	flags.StringVar(&c.synonyms, "synonyms", c.synonyms, "Path to a Solr or WordNet prolog synonym file")
+	flags.StringVar(&c.synonymExpansion, "synonym-expansion", c.synonymExpansion, "When synonyms are expanded: query or index")
+	flags.IntVar(&c.analyzer.Shingles, "shingles", c.analyzer.Shingles, "Index word shingles of up to this many words to boost adjacent query terms, e.g. 2")
+	flags.IntVar(&c.analyzer.NGramMin, "ngram-min", c.analyzer.NGramMin, "Smallest character n-gram terms are split into, for use with -ngram-max")
+	flags.IntVar(&c.analyzer.NGramMax, "ngram-max", c.analyzer.NGramMax, "Largest character n-gram terms are split into, or 0 to index whole terms")
+	flags.BoolVar(&c.exactIndex, "exact-index", c.exactIndex, "Build an unstemmed shadow index for \"=term\" exact-match queries; without it, \"=term\" matches stems like a regular term")
+	flags.StringVar(&c.scoring, "scoring", c.scoring, "Formula ranking the results: tfidf or bm25")
+	flags.IntVar(&c.cacheSize, "cache-size", c.cacheSize, "Number of query results kept in the cache, or 0 to disable the cache")
+	flags.DurationVar(&c.cacheTTL, "cache-ttl", c.cacheTTL, "Time a cached query result is reused, or 0 for no limit")
+}
+
+// withVariant returns the settings with the flags of a variant applied on top of them, as in
+// "-stemmer minimal -synonyms 'my synonyms.txt'". The settings themselves are left unchanged.
+// Parameters:
+//
+//	variant: the flags of the variant, split like a shell does, with single or double quotes around values with spaces.
+//
+// Return values:
+//
+//	engineSettings: the settings of the variant.
+//	error: an error if the variant is badly quoted, or holds anything but valid engine flags.
+func (c engineSettings) withVariant(variant string) (engineSettings, error) {
+	args, err := splitFlags(variant)
+	if err != nil {
+		return c, fmt.Errorf("-variant: %w", err)
+	}
+	flags := flag.NewFlagSet("-variant", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	c.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return c, fmt.Errorf("-variant: %w", err)
+	}
+	if flags.NArg() > 0 {
+		return c, fmt.Errorf("-variant: unexpected argument %q", flags.Arg(0))
+	}
+	return c, nil
+}
+
+// splitFlags splits a command line into arguments at unquoted whitespace. Single or double quotes group
+// the characters between them, including spaces, into the argument, and are removed.
+func splitFlags(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	for _, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote, inArg = c, true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, line)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// options builds the SearchEngine options selected by the settings:
+// the analyzer of the language, the exact shadow index, stop word indexing and synonyms.
+// Return values:
+//
+//	[]handlers.Option: the options to pass to the SearchEngine.
+//	error: an error if a setting is invalid or a stop word or synonym file cannot be loaded.
+func (c engineSettings) options() ([]handlers.Option, error) {
+	// Load the custom stop word list, if any.
+	analyzerConfig := c.analyzer
+	if c.stopWords != "" {
+		stopWords, err := handlers.LoadStopWords(c.stopWords)
+		if err != nil {
+			return nil, err
+		}
+		analyzerConfig.StopWords = stopWords
+	}
+
+	// Pick the analyzer for the language of the documents.
+	analyzer, err := handlers.NewAnalyzer(analyzerConfig)
+	if err != nil {
+		return nil, err
+	}
+	options := []handlers.Option{handlers.WithAnalyzer(analyzer)}
+
+	// Pick the scoring formula.
+	scoring, err := parseScoring(c.scoring)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, handlers.WithScoring(scoring))
 
-	// Print a message indicating that the application is listening on port 3000.
-	fmt.Println("Listening on :3000")
+	// Build the unstemmed analyzer of the shadow index, unless the index is not stemmed anyway.
+	if c.exactIndex && analyzerConfig.Stemmer != "none" {
+		exactConfig := analyzerConfig
+		exactConfig.Stemmer = "none"
+		exactAnalyzer, err := handlers.NewAnalyzer(exactConfig)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, handlers.WithExactIndex(exactAnalyzer))
+	}
+	if c.indexStopWords {
+		options = append(options, handlers.WithStopWordsIndexed())
+	}
+	if c.cacheSize > 0 {
+		options = append(options, handlers.WithQueryCache(c.cacheSize, c.cacheTTL))
+	}
 
-	// Start the HTTP server and listen on port 3000.
-	http.ListenAndServe(":3000", nil)
+	// Load the synonym rules, analyzed like the documents.
+	if c.synonyms != "" {
+		expansion := handlers.QueryTimeSynonyms
+		switch c.synonymExpansion {
+		case "query":
+		case "index":
+			expansion = handlers.IndexTimeSynonyms
+		default:
+			return nil, fmt.Errorf("invalid -synonym-expansion %q, expected query or index", c.synonymExpansion)
+		}
+		synonyms, err := handlers.LoadSynonyms(c.synonyms, analyzer)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, handlers.WithSynonyms(synonyms, expansion))
+	}
+	return options, nil
+}
+
+// loadEngine builds a SearchEngine with the options of the settings, and indexes the documents of path.
+func loadEngine(path string, settings engineSettings) (*handlers.SearchEngine, error) {
+	options, err := settings.options()
+	if err != nil {
+		return nil, err
+	}
+	engine := handlers.New(options...)
+	if err := engine.LoadDocuments(path); err != nil {
+		return nil, err
+	}
+	engine.IndexDoc()
+	return engine, nil
+}
+
+// parseScoring returns the scoring formula with the given name: tfidf or bm25.
+func parseScoring(name string) (handlers.Scoring, error) {
+	switch name {
+	case "tfidf":
+		return handlers.TFIDFScoring, nil
+	case "bm25":
+		return handlers.BM25Scoring, nil
+	}
+	return 0, fmt.Errorf("invalid scoring %q, expected tfidf or bm25", name)
 }
 
 // SearchHandler handles the "/search" path and processes the search query.
@@ -65,22 +369,104 @@ func SearchHandler(writer http.ResponseWriter, request *http.Request) {
 		fmt.Fprintf(writer, "No query provided")
 		return
 	}
-	var docs []int
-	if strings.Contains(query, "\"") {
-		docs = SearchEngine.SearchPhrase(query)
-	} else if strings.Contains(query, "*") {
-		docs = SearchEngine.FindWildcardMatches(query)
-	} else {
-		docs = SearchEngine.Search(query)
+	ctx, cancel := queryContext(request)
+	defer cancel()
+	start := time.Now()
+	mode := queryModeOf(query)
+	result, err := runQuery(ctx, SearchEngine, mode, query)
+	recordQuery(mode, time.Since(start), result, err)
+	info := requestInfoOf(request)
+	info.query, info.mode, info.err = query, mode, err
+	if err != nil {
+		queryError(writer, err)
+		return
+	}
+	info.hits = result.Total
+	if request.FormValue("format") == "json" {
+		writeJSONResult(writer, request, query, mode, result)
+		return
 	}
 
-	if docs == nil || len(docs) <= 0 {
+	if result.Total == 0 {
 		fmt.Fprintf(writer, "No results found")
 	}
-	for i, _ := range docs {
-		doc := SearchEngine.Documents[docs[i]]
+	for _, hit := range result.Hits {
+		doc := SearchEngine.Documents[hit.DocID]
 		item := views.Item(doc.Title, fmt.Sprint(doc.ID))
-		item.Render(context.Background(), writer)
+		item.Render(request.Context(), writer)
+	}
+}
+
+// runQuery runs a query on the engine in the given mode, as returned by queryModeOf.
+func runQuery(ctx context.Context, engine *handlers.SearchEngine, mode string, query string) (*handlers.SearchResult, error) {
+	switch mode {
+	case "phrase":
+		return engine.SearchPhrase(ctx, query)
+	case "wildcard":
+		return engine.FindWildcardMatches(ctx, query)
+	default:
+		return engine.Search(ctx, query)
+	}
+}
+
+// jsonResult is the JSON form of a search result, written by the "/search" path when "format=json" is requested.
+type jsonResult struct {
+	Query     string    `json:"query"`
+	Mode      string    `json:"mode"`
+	Total     int       `json:"total"`      // Number of matching documents.
+	ElapsedMs float64   `json:"elapsed_ms"` // Time spent evaluating the query, in milliseconds.
+	Hits      []jsonHit `json:"hits"`       // The best "limit" hits (10 by default), best first.
+}
+
+// jsonHit is the JSON form of a hit.
+type jsonHit struct {
+	ID    int     `json:"id"`
+	Title string  `json:"title"`
+	Score float64 `json:"score"`
+}
+
+// writeJSONResult writes the result of a query as JSON, limited to the number of hits in the "limit" parameter.
+func writeJSONResult(writer http.ResponseWriter, request *http.Request, query string, mode string, result *handlers.SearchResult) {
+	limit, err := strconv.Atoi(request.FormValue("limit"))
+	if err != nil || limit < 0 {
+		limit = 10
+	}
+	response := jsonResult{Query: query, Mode: mode, Total: result.Total, ElapsedMs: milliseconds(result.Elapsed), Hits: []jsonHit{}}
+	for _, hit := range result.Hits[:min(limit, len(result.Hits))] {
+		response.Hits = append(response.Hits, jsonHit{ID: hit.DocID, Title: SearchEngine.Documents[hit.DocID].Title, Score: hit.Score})
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(response)
+}
+
+// queryModeOf returns the mode of a query: "phrase" for queries containing '"', "wildcard" for queries containing '*'
+// and "regular" for the others.
+func queryModeOf(query string) string {
+	if strings.Contains(query, "\"") {
+		return "phrase"
+	} else if strings.Contains(query, "*") {
+		return "wildcard"
+	}
+	return "regular"
+}
+
+// queryContext returns the context of a query: the context of the request, which is canceled when the client
+// goes away or htmx supersedes the request, limited to the -timeout duration when one is set.
+func queryContext(request *http.Request) (context.Context, context.CancelFunc) {
+	if queryTimeout <= 0 {
+		return context.WithCancel(request.Context())
+	}
+	return context.WithTimeout(request.Context(), queryTimeout)
+}
+
+// queryError reports a query that did not complete. Invalid queries get a 400 response and timed out
+// queries a 503 response; nothing is written for canceled queries, whose client is gone.
+func queryError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, handlers.ErrInvalidQuery):
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(writer, "Query timed out", http.StatusServiceUnavailable)
 	}
 }
 
@@ -93,5 +479,39 @@ func DocHandler(writer http.ResponseWriter, request *http.Request) {
 	id, _ := strconv.Atoi(query)                                        // Convert the document ID to an integer.
 	doc := SearchEngine.Documents[id]                                   // Fetch the document from SearchEngine.Documents using the ID.
 	page := views.DocumentPage(doc.Title, doc.Text, fmt.Sprint(doc.ID)) // Create a view for the document with its title, text, and ID.
-	page.Render(context.Background(), writer)                           // Render the view to the response.
+	page.Render(request.Context(), writer)                              // Render the view to the response.
+}
+
+// ExplainHandler handles the "/explain" path and explains how a query scores a document.
+// It takes the query from the "q" parameter and the document ID from the "id" parameter,
+// and writes the analysis of the query and the breakdown of the document score as plain text.
+func ExplainHandler(writer http.ResponseWriter, request *http.Request) {
+	query := request.FormValue("q")
+	if len(query) == 0 {
+		http.Error(writer, "No query provided", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		http.Error(writer, "Invalid document ID", http.StatusBadRequest)
+		return
+	}
+	requestInfoOf(request).query = query
+	ctx, cancel := queryContext(request)
+	defer cancel()
+	explanation, err := SearchEngine.Explain(ctx, query, id)
+	if ctx.Err() != nil {
+		queryError(writer, ctx.Err())
+		return
+	}
+	if errors.Is(err, handlers.ErrInvalidQuery) {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(writer, explanation)
 }
@@ -0,0 +1,298 @@
+// Package metrics implements the counters, gauges and histograms exposed on the /metrics endpoint,
+// written in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the latency histograms, in seconds.
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector is a metric family that can write itself in the text format.
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics exposed by a Handler.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds a metric family to the registry.
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes every metric of the registry in the Prometheus text exposition format, in registration order.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	buffered := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// Handler returns an HTTP handler serving the metrics of the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(writer)
+	})
+}
+
+// family holds the name, help and label names shared by the series of a metric.
+type family struct {
+	name   string
+	help   string
+	kind   string // "counter", "gauge" or "histogram".
+	labels []string
+}
+
+// header writes the HELP and TYPE lines of the family.
+func (f *family) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// key joins label values into a map key.
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats label names and values as {name="value",...}, with extra pairs appended, or "" without labels.
+func labelPairs(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+"=\""+escapeLabel(values[i])+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escapeLabel(extra[i+1])+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabel escapes a label value: backslashes, double quotes and line feeds.
+func escapeLabel(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+// escapeHelp escapes a help text: backslashes and line feeds.
+func escapeHelp(help string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(help)
+}
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// checkLabels panics when the number of label values does not match the label names, which is a programming error.
+func (f *family) checkLabels(values []string) {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+}
+
+// sortedKeys returns the keys of a series map in order, so the output is stable between scrapes.
+func sortedKeys[V any](series map[string]V) []string {
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	family
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+// counterSeries is the counter of one set of label values.
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+// NewCounterVec registers a counter with the given label names.
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family: family{name: name, help: help, kind: "counter", labels: labels}, series: make(map[string]*counterSeries)}
+	r.register(c)
+	return c
+}
+
+// Add adds delta, which must not be negative, to the counter of the label values.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.checkLabels(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	series, ok := c.series[key(values)]
+	if !ok {
+		series = &counterSeries{values: values}
+		c.series[key(values)] = series
+	}
+	series.value += delta
+}
+
+// Inc adds one to the counter of the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// write writes every series of the counter.
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range sortedKeys(c.series) {
+		series := c.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, series.values), formatFloat(series.value))
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	family
+	buckets []float64 // Sorted upper bounds, without +Inf.
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+// histogramSeries is the histogram of one set of label values.
+type histogramSeries struct {
+	values []string
+	counts []uint64 // Observations per bucket, not cumulative; the last one counts observations above every bound.
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec registers a histogram with the given bucket upper bounds and label names.
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		family:  family{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: sorted,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds an observation to the histogram of the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.checkLabels(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[key(values)]
+	if !ok {
+		series = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key(values)] = series
+	}
+	series.counts[sort.SearchFloat64s(h.buckets, v)]++
+	series.sum += v
+	series.count++
+}
+
+// write writes the cumulative buckets, sum and count of every series of the histogram.
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.series) {
+		series := h.series[k]
+		var cumulative uint64
+		for i, bound := range append(h.buckets, math.Inf(1)) {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, series.values, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, series.values), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, series.values), series.count)
+	}
+}
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct {
+	family
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+// NewGaugeVec registers a gauge with the given label names.
+func (r *Registry) NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{family: family{name: name, help: help, kind: "gauge", labels: labels}, series: make(map[string]*counterSeries)}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge of the label values.
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.checkLabels(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.series[key(values)] = &counterSeries{values: values, value: v}
+}
+
+// write writes every series of the gauge.
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.header(w)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, k := range sortedKeys(g.series) {
+		series := g.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelPairs(g.labels, series.values), formatFloat(series.value))
+	}
+}
+
+// funcMetric is an unlabeled counter or gauge whose value is read when the metrics are written.
+type funcMetric struct {
+	family
+	fn func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn at every scrape.
+func (r *Registry) NewGaugeFunc(name string, help string, fn func() float64) {
+	r.register(&funcMetric{family: family{name: name, help: help, kind: "gauge"}, fn: fn})
+}
+
+// NewCounterFunc registers a counter whose value, which must never decrease, is returned by fn at every scrape.
+func (r *Registry) NewCounterFunc(name string, help string, fn func() float64) {
+	r.register(&funcMetric{family: family{name: name, help: help, kind: "counter"}, fn: fn})
+}
+
+// write writes the current value of the metric.
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.header(w)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.fn()))
+}
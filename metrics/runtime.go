@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// memStatsMaxAge is how long the memory statistics read for a scrape are reused,
+// since runtime.ReadMemStats briefly stops the world.
+const memStatsMaxAge = time.Second
+
+// RegisterRuntime registers the Go runtime metrics: goroutines, threads, heap and garbage collector statistics.
+func (r *Registry) RegisterRuntime() {
+	var mu sync.Mutex
+	var stats runtime.MemStats
+	var read time.Time
+	mem := func(field func(*runtime.MemStats) float64) func() float64 {
+		return func() float64 {
+			mu.Lock()
+			defer mu.Unlock()
+			if time.Since(read) > memStatsMaxAge {
+				runtime.ReadMemStats(&stats)
+				read = time.Now()
+			}
+			return field(&stats)
+		}
+	}
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	r.NewGaugeFunc("go_threads", "Number of OS threads created.", func() float64 {
+		threads, _ := runtime.ThreadCreateProfile(nil)
+		return float64(threads)
+	})
+	r.NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.Alloc) }))
+	r.NewCounterFunc("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.TotalAlloc) }))
+	r.NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from the system.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.Sys) }))
+	r.NewGaugeFunc("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.HeapInuse) }))
+	r.NewGaugeFunc("go_memstats_heap_objects", "Number of allocated objects.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.HeapObjects) }))
+	r.NewCounterFunc("go_gc_cycles_total", "Number of completed garbage collection cycles.",
+		mem(func(m *runtime.MemStats) float64 { return float64(m.NumGC) }))
+	r.NewCounterFunc("go_gc_pause_seconds_total", "Total time the garbage collector stopped the world.",
+		mem(func(m *runtime.MemStats) float64 { return time.Duration(m.PauseTotalNs).Seconds() }))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"FullText_SearchEngine/handlers"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ready is set once the index is built. Until then, only "/status" and "/metrics" are served.
+var ready atomic.Bool
+
+// statusResponse is the JSON form of the ingest progress, written by the "/status" path.
+type statusResponse struct {
+	Ready          bool    `json:"ready"`
+	Phase          string  `json:"phase"`
+	Documents      int     `json:"documents"`       // Documents read or indexed so far in the phase.
+	TotalDocuments int     `json:"total_documents"` // Documents to index in the phase, or 0 when unknown.
+	Bytes          int64   `json:"bytes"`           // Bytes of the corpus read so far.
+	TotalBytes     int64   `json:"total_bytes"`     // Size of the corpus, or 0 when unknown.
+	DocsPerSecond  float64 `json:"docs_per_sec"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	ETASeconds     float64 `json:"eta_seconds"` // Estimated time left in the phase, or -1 when unknown.
+	HeapBytes      uint64  `json:"heap_bytes"`
+	Resumed        int     `json:"resumed"`  // Documents restored from committed segments.
+	Segments       int     `json:"segments"` // Segments committed to the checkpoint directory.
+}
+
+// StatusHandler handles the "/status" path and writes the progress of the ingest as JSON.
+// It answers while the index is still being built, so the warm-up of the server can be followed.
+func StatusHandler(writer http.ResponseWriter, request *http.Request) {
+	progress := SearchEngine.Progress()
+	eta := -1.0
+	if d := progress.ETA(); d >= 0 {
+		eta = d.Seconds()
+	}
+	response := statusResponse{
+		Ready:          ready.Load(),
+		Phase:          progress.Phase,
+		Documents:      progress.Documents,
+		TotalDocuments: progress.TotalDocuments,
+		Bytes:          progress.Bytes,
+		TotalBytes:     progress.TotalBytes,
+		DocsPerSecond:  progress.Rate(),
+		ElapsedSeconds: progress.Elapsed.Seconds(),
+		ETASeconds:     eta,
+		HeapBytes:      progress.HeapBytes,
+		Resumed:        progress.Resumed,
+		Segments:       progress.Segments,
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(response)
+}
+
+// whenReady serves the handler once the index is built, and answers 503 while the server is warming up.
+func whenReady(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !ready.Load() {
+			writer.Header().Set("Retry-After", "10")
+			http.Error(writer, "Index is warming up, see /status", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// reportProgress logs the progress of the ingest of the engine on the standard error every interval,
+// until done is closed.
+func reportProgress(engine *handlers.SearchEngine, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			progress := engine.Progress()
+			attrs := []any{
+				"phase", progress.Phase,
+				"documents", progress.Documents,
+				"docs_per_sec", progress.Rate(),
+				"heap_bytes", progress.HeapBytes,
+			}
+			if progress.TotalBytes > 0 {
+				attrs = append(attrs, "bytes", progress.Bytes, "total_bytes", progress.TotalBytes)
+			}
+			if eta := progress.ETA(); eta >= 0 {
+				attrs = append(attrs, "eta", eta.Round(time.Second).String())
+			}
+			logger.Info("ingest", attrs...)
+		}
+	}
+}